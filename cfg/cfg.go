@@ -0,0 +1,238 @@
+package cfg
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strings"
+    "monkey_compiler/code"
+    "monkey_compiler/compiler"
+)
+
+// A straight line of instructions with a single entry at Start.
+// Start and End are positions in the original instructions, End exclusive.
+type Block struct {
+    ID int
+    Start int
+    End int
+    Instructions code.Instructions
+
+    Succs []*Edge
+    Preds []*Edge
+}
+
+type EdgeKind string
+
+const (
+    // the block falls into the next one
+    FallThrough EdgeKind = "fallthrough"
+    // an unconditional jump
+    Jump EdgeKind = "jump"
+    // a conditional jump that was taken
+    Taken EdgeKind = "taken"
+    // one case of an OpJumpTable
+    Case EdgeKind = "case"
+    // a thrown value unwinding to a handler
+    Exception EdgeKind = "exception"
+)
+
+type Edge struct {
+    From *Block
+    To *Block
+    Kind EdgeKind
+}
+
+type Graph struct {
+    Blocks []*Block
+    // a block whose Start is the end of the instructions, the target of
+    // jumps past the last instruction
+    Exit *Block
+}
+
+func (g *Graph) Entry() *Block {
+    if len(g.Blocks) == 0 {
+        return g.Exit
+    }
+    return g.Blocks[0]
+}
+
+// Build the graph of plain instructions.
+// OpJumpTable and OpThrow have no successors here, use BuildBytecode to
+// follow jump tables and handlers.
+func Build(ins code.Instructions) (*Graph, error) {
+    return build(&compiler.Bytecode{Instructions: ins})
+}
+
+// Build the graph including jump table cases and exception edges.
+func BuildBytecode(bc *compiler.Bytecode) (*Graph, error) {
+    return build(bc)
+}
+
+func build(bc *compiler.Bytecode) (*Graph, error) {
+    insts, err := code.Decode(bc.Instructions)
+    if err != nil {
+        return nil, err
+    }
+    size := len(bc.Instructions)
+
+    // leaders: the first instruction, every jump target and every
+    // instruction following a jump
+    leaders := map[int]bool{0: true, size: true}
+    for _, in := range insts {
+        if code.Has(in.Op, code.Jump) {
+            leaders[in.Operands[0]] = true
+        }
+        if code.Has(in.Op, code.Branch) || code.Has(in.Op, code.NoFallthrough) {
+            leaders[in.Offset + in.Width] = true
+        }
+    }
+    for _, table := range bc.JumpTables {
+        for _, t := range table.Targets {
+            leaders[t] = true
+        }
+        leaders[table.Default] = true
+    }
+    for _, h := range bc.Handlers {
+        leaders[h.Start] = true
+        leaders[h.End] = true
+        leaders[h.Target] = true
+    }
+
+    starts := []int{}
+    for pos := range leaders {
+        if pos < 0 || pos > size {
+            return nil, fmt.Errorf("jump target %d out of range", pos)
+        }
+        starts = append(starts, pos)
+    }
+    sort.Ints(starts)
+
+    g := &Graph{}
+    byStart := map[int]*Block{}
+    for i, start := range starts {
+        end := size
+        if i + 1 < len(starts) {
+            end = starts[i + 1]
+        }
+
+        b := &Block{ID: i, Start: start, End: end, Instructions: bc.Instructions[start:end]}
+        byStart[start] = b
+        if start == size {
+            g.Exit = b
+        } else {
+            g.Blocks = append(g.Blocks, b)
+        }
+    }
+    g.Exit.ID = len(g.Blocks)
+
+    // every leader must be the start of an instruction
+    positions := map[int]bool{size: true}
+    for _, in := range insts {
+        positions[in.Offset] = true
+    }
+    for _, start := range starts {
+        if !positions[start] {
+            return nil, fmt.Errorf("jump target %d is inside an instruction", start)
+        }
+    }
+
+    lasts := map[*Block]code.Instruction{}
+    bi := 0
+    for _, in := range insts {
+        for g.Blocks[bi].End <= in.Offset {
+            bi++
+        }
+        lasts[g.Blocks[bi]] = in
+    }
+
+    for _, b := range g.Blocks {
+        last := lasts[b]
+        next := byStart[b.End]
+
+        switch {
+        case last.Op == code.OpJump:
+            link(b, byStart[last.Operands[0]], Jump)
+        case code.Has(last.Op, code.Jump):
+            link(b, byStart[last.Operands[0]], Taken)
+            link(b, next, FallThrough)
+        case last.Op == code.OpJumpTable:
+            if last.Operands[0] < len(bc.JumpTables) {
+                table := bc.JumpTables[last.Operands[0]]
+                for _, t := range table.Targets {
+                    link(b, byStart[t], Case)
+                }
+                link(b, byStart[table.Default], Case)
+            }
+        case last.Op == code.OpThrow:
+        default:
+            link(b, next, FallThrough)
+        }
+
+        for _, h := range bc.Handlers {
+            if h.Start <= b.Start && b.Start < h.End {
+                link(b, byStart[h.Target], Exception)
+            }
+        }
+    }
+
+    return g, nil
+}
+
+func link(from, to *Block, kind EdgeKind) {
+    for _, e := range from.Succs {
+        if e.To == to && e.Kind == kind {
+            return
+        }
+    }
+
+    e := &Edge{From: from, To: to, Kind: kind}
+    from.Succs = append(from.Succs, e)
+    to.Preds = append(to.Preds, e)
+}
+
+// Render the graph in Graphviz DOT format.
+func (g *Graph) Dot() string {
+    var out bytes.Buffer
+
+    out.WriteString("digraph cfg {\n")
+    out.WriteString("    node [shape=box, fontname=\"monospace\"];\n")
+
+    for _, b := range g.Blocks {
+        fmt.Fprintf(&out, "    b%d [label=\"%s\"];\n", b.ID, blockLabel(b))
+    }
+    fmt.Fprintf(&out, "    b%d [label=\"exit\", shape=oval];\n", g.Exit.ID)
+
+    for _, b := range g.Blocks {
+        for _, e := range b.Succs {
+            switch e.Kind {
+            case FallThrough:
+                fmt.Fprintf(&out, "    b%d -> b%d;\n", e.From.ID, e.To.ID)
+            case Exception:
+                fmt.Fprintf(&out, "    b%d -> b%d [label=\"%s\", style=dashed];\n", e.From.ID, e.To.ID, e.Kind)
+            default:
+                fmt.Fprintf(&out, "    b%d -> b%d [label=\"%s\"];\n", e.From.ID, e.To.ID, e.Kind)
+            }
+        }
+    }
+
+    out.WriteString("}\n")
+    return out.String()
+}
+
+// Left aligned lines in the same format as Instructions.String().
+func blockLabel(b *Block) string {
+    var out bytes.Buffer
+
+    insts, _ := code.Decode(b.Instructions)
+    for _, in := range insts {
+        def, _ := code.Lookup(byte(in.Op))
+        fields := []string{fmt.Sprintf("%04d", b.Start + in.Offset), def.Name}
+        for _, operand := range in.Operands {
+            fields = append(fields, fmt.Sprintf("%d", operand))
+        }
+        out.WriteString(strings.Join(fields, " "))
+        out.WriteString("\\l")
+    }
+
+    return out.String()
+}
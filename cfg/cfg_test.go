@@ -0,0 +1,171 @@
+package cfg
+
+import (
+    "testing"
+    "monkey_interpreter/lexer"
+    "monkey_interpreter/parser"
+    "monkey_compiler/code"
+    "monkey_compiler/compiler"
+)
+
+func TestBuild(t *testing.T) {
+    // 0000 OpTrue
+    // 0001 OpJumpNotTruthy 10
+    // 0004 OpConst 0
+    // 0007 OpJump 13
+    // 0010 OpConst 1
+    // 0013 OpPop
+    bc := compile(t, "if (true) { 10 } else { 20 }")
+
+    g, err := Build(bc.Instructions)
+    if err != nil {
+        t.Fatalf("Build failed: %s", err)
+    }
+
+    expectedBlocks := [][2]int{{0, 4}, {4, 10}, {10, 13}, {13, 14}}
+    if len(g.Blocks) != len(expectedBlocks) {
+        t.Fatalf("wrong number of blocks. want=%d, got=%d", len(expectedBlocks), len(g.Blocks))
+    }
+    for i, want := range expectedBlocks {
+        b := g.Blocks[i]
+        if b.Start != want[0] || b.End != want[1] {
+            t.Errorf("wrong block %d. want=%v, got=[%d %d]", i, want, b.Start, b.End)
+        }
+    }
+
+    expectedSuccs := [][]edge{
+        {{2, Taken}, {1, FallThrough}},
+        {{3, Jump}},
+        {{3, FallThrough}},
+        {{4, FallThrough}},
+    }
+    for i, want := range expectedSuccs {
+        testSuccs(t, g.Blocks[i], want)
+    }
+
+    if len(g.Blocks[3].Preds) != 2 {
+        t.Errorf("join block should have 2 preds. got=%d", len(g.Blocks[3].Preds))
+    }
+    if g.Exit.Start != len(bc.Instructions) {
+        t.Errorf("exit block at wrong position. got=%d", g.Exit.Start)
+    }
+}
+
+func TestBuildBytecode(t *testing.T) {
+    // 0000 OpGetGlobal 0
+    // 0003 OpJumpTable 0
+    // 0006 OpConst 0
+    // 0009 OpThrow
+    // 0010 OpPop
+    bc := &compiler.Bytecode{
+        Instructions: concatInstructions(
+            code.Make(code.OpGetGlobal, 0),
+            code.Make(code.OpJumpTable, 0),
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpThrow),
+            code.Make(code.OpPop),
+        ),
+        Handlers: []compiler.Handler{{Start: 6, End: 10, Target: 10}},
+        JumpTables: []compiler.JumpTable{{Min: 0, Targets: []int{6}, Default: 10}},
+    }
+
+    g, err := BuildBytecode(bc)
+    if err != nil {
+        t.Fatalf("BuildBytecode failed: %s", err)
+    }
+
+    expectedSuccs := [][]edge{
+        {{1, Case}, {2, Case}},
+        {{2, Exception}},
+        {{3, FallThrough}},
+    }
+    if len(g.Blocks) != len(expectedSuccs) {
+        t.Fatalf("wrong number of blocks. want=%d, got=%d", len(expectedSuccs), len(g.Blocks))
+    }
+    for i, want := range expectedSuccs {
+        testSuccs(t, g.Blocks[i], want)
+    }
+}
+
+func TestBuildErrors(t *testing.T) {
+    tests := []code.Instructions{
+        code.Make(code.OpJump, 100),
+        concatInstructions(code.Make(code.OpJump, 1), code.Make(code.OpConst, 0)),
+        code.Instructions{255},
+    }
+
+    for _, ins := range tests {
+        _, err := Build(ins)
+        if err == nil {
+            t.Errorf("expected an error for %v", ins)
+        }
+    }
+}
+
+func TestDot(t *testing.T) {
+    bc := compile(t, "if (true) { 10 }")
+
+    g, err := Build(bc.Instructions)
+    if err != nil {
+        t.Fatalf("Build failed: %s", err)
+    }
+
+    expected := `digraph cfg {
+    node [shape=box, fontname="monospace"];
+    b0 [label="0000 OpTrue\l0001 OpJumpNotTruthy 10\l"];
+    b1 [label="0004 OpConst 0\l0007 OpJump 11\l"];
+    b2 [label="0010 OpNull\l"];
+    b3 [label="0011 OpPop\l"];
+    b4 [label="exit", shape=oval];
+    b0 -> b2 [label="taken"];
+    b0 -> b1;
+    b1 -> b3 [label="jump"];
+    b2 -> b3;
+    b3 -> b4;
+}
+`
+
+    if g.Dot() != expected {
+        t.Errorf("wrong DOT output.\nwant=%s\ngot=%s", expected, g.Dot())
+    }
+}
+
+type edge struct {
+    to int
+    kind EdgeKind
+}
+
+func testSuccs(t *testing.T, b *Block, expected []edge) {
+    t.Helper()
+
+    if len(b.Succs) != len(expected) {
+        t.Errorf("block %d has wrong number of succs. want=%d, got=%d", b.ID, len(expected), len(b.Succs))
+        return
+    }
+    for i, want := range expected {
+        e := b.Succs[i]
+        if e.To.ID != want.to || e.Kind != want.kind {
+            t.Errorf("block %d succ %d wrong. want=%v, got={%d %s}", b.ID, i, want, e.To.ID, e.Kind)
+        }
+    }
+}
+
+func compile(t *testing.T, input string) *compiler.Bytecode {
+    t.Helper()
+
+    p := parser.New(lexer.New(input))
+    comp := compiler.New()
+    err := comp.Compile(p.ParseProgram())
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    return comp.Bytecode()
+}
+
+func concatInstructions(insts ...[]byte) code.Instructions {
+    out := code.Instructions{}
+    for _, ins := range insts {
+        out = append(out, ins...)
+    }
+    return out
+}
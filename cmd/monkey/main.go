@@ -0,0 +1,458 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/lexer"
+    "monkey_interpreter/object"
+    "monkey_interpreter/parser"
+    "monkey_compiler/cfg"
+    "monkey_compiler/code"
+    "monkey_compiler/compiler"
+    "monkey_compiler/vm"
+)
+
+const usage = `usage: monkey <command> [arguments]
+
+commands:
+    build [-O] [-c] [-o output] [-format mbc|json] <file>
+                       compile a program to a .mbc bytecode file, or to
+                       JSON for tools (-o - writes to standard output).
+                       With -c, compile a .mbo unit for link
+    link [-O] [-o output] <file>...
+                       link .mbo units or source files, in the order they
+                       run, into a .mbc bytecode file
+    run [-O] <file>    run a program, from source or from a .mbc file
+    disasm [-O] <file> print the assembly of a program, from source or from
+                       a .mbc file
+    stats [-O] <file>  report instruction bytes per opcode, the constant pool
+                       by type and the largest operands, from source or from
+                       a .mbc file
+    cfg [-O] <file>    print the control-flow graph of a program in DOT format
+    superinst [-n length] [-top count] <file>...
+                       run programs with the opcode profiler and list the
+                       most executed opcode sequences as superinstruction
+                       candidates; adding one is still done by hand
+`
+
+// The compiler passes turned on by -O.
+var optimizations = compiler.Options{
+    FoldConstants: true,
+    Peephole: true,
+    DeadBranches: true,
+    Superinstructions: true,
+}
+
+func main() {
+    if len(os.Args) < 2 {
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+
+    var err error
+    switch os.Args[1] {
+    case "build":
+        err = runBuild(os.Args[2:])
+    case "link":
+        err = runLink(os.Args[2:])
+    case "run":
+        err = runRun(os.Args[2:])
+    case "disasm":
+        err = runDisasm(os.Args[2:])
+    case "stats":
+        err = runStats(os.Args[2:])
+    case "cfg":
+        err = runCfg(os.Args[2:])
+    case "superinst":
+        err = runSuperinst(os.Args[2:])
+    default:
+        fmt.Fprint(os.Stderr, usage)
+        os.Exit(2)
+    }
+
+    if err != nil {
+        fmt.Fprintf(os.Stderr, "monkey %s: %s\n", os.Args[1], err)
+        os.Exit(1)
+    }
+}
+
+func runBuild(args []string) error {
+    flags := flag.NewFlagSet("build", flag.ExitOnError)
+    optimize := flags.Bool("O", false, "enable compiler optimizations")
+    output := flags.String("o", "", "output file (default: the source file with the format's extension)")
+    format := flags.String("format", "mbc", "output format, mbc or json")
+    unit := flags.Bool("c", false, "compile a unit to link with others")
+    flags.Parse(args)
+
+    if flags.NArg() != 1 {
+        return fmt.Errorf("expected one source file")
+    }
+    path := flags.Arg(0)
+
+    ext := compiler.FileExtension
+    switch *format {
+    case "mbc":
+    case "json":
+        ext = ".json"
+    default:
+        return fmt.Errorf("unknown format %s", *format)
+    }
+
+    opts := compiler.Options{}
+    if *optimize {
+        opts = optimizations
+    }
+
+    if *unit {
+        if *format != "mbc" {
+            return fmt.Errorf("-c writes only .mbo units")
+        }
+        u, err := compileUnitFile(path, opts)
+        if err != nil {
+            return err
+        }
+        if *output == "" {
+            *output = strings.TrimSuffix(path, filepath.Ext(path)) + compiler.UnitFileExtension
+        }
+        return u.Save(*output)
+    }
+
+    bytecode, err := compileFile(path, opts)
+    if err != nil {
+        return err
+    }
+
+    if *output == "" {
+        *output = strings.TrimSuffix(path, filepath.Ext(path)) + ext
+    }
+
+    var data []byte
+    if *format == "json" {
+        data, err = json.MarshalIndent(bytecode, "", "  ")
+        data = append(data, '\n')
+    } else {
+        data, err = bytecode.MarshalBinary()
+    }
+    if err != nil {
+        return err
+    }
+
+    if *output == "-" {
+        _, err = os.Stdout.Write(data)
+        return err
+    }
+    return ioutil.WriteFile(*output, data, 0644)
+}
+
+// The output is named after the last file, usually the script.
+func runLink(args []string) error {
+    flags := flag.NewFlagSet("link", flag.ExitOnError)
+    optimize := flags.Bool("O", false, "enable compiler optimizations for source files")
+    output := flags.String("o", "", "output file (default: the last file with a .mbc extension)")
+    flags.Parse(args)
+
+    if flags.NArg() == 0 {
+        return fmt.Errorf("expected units or source files")
+    }
+
+    opts := compiler.Options{}
+    if *optimize {
+        opts = optimizations
+    }
+
+    units := []*compiler.Unit{}
+    for _, path := range flags.Args() {
+        var u *compiler.Unit
+        var err error
+        if filepath.Ext(path) == compiler.UnitFileExtension {
+            u, err = compiler.LoadUnit(path)
+        } else {
+            u, err = compileUnitFile(path, opts)
+        }
+        if err != nil {
+            return err
+        }
+        units = append(units, u)
+    }
+
+    bytecode, err := compiler.Link(units...)
+    if err != nil {
+        return err
+    }
+
+    if *output == "" {
+        last := flags.Arg(flags.NArg() - 1)
+        *output = strings.TrimSuffix(last, filepath.Ext(last)) + compiler.FileExtension
+    }
+    return bytecode.Save(*output)
+}
+
+// Print the result of the program like the REPL does.
+func runRun(args []string) error {
+    flags := flag.NewFlagSet("run", flag.ExitOnError)
+    optimize := flags.Bool("O", false, "enable compiler optimizations for source files")
+    flags.Parse(args)
+
+    if flags.NArg() != 1 {
+        return fmt.Errorf("expected one file")
+    }
+
+    opts := compiler.Options{}
+    if *optimize {
+        opts = optimizations
+    }
+
+    bytecode, err := loadFile(flags.Arg(0), opts)
+    if err != nil {
+        return err
+    }
+
+    machine := vm.New(bytecode)
+    err = machine.Run()
+    if err != nil {
+        return err
+    }
+    if result := machine.Result(); result != nil {
+        fmt.Println(result.Inspect())
+    }
+    return nil
+}
+
+// The output reads back with compiler.Assemble.
+func runDisasm(args []string) error {
+    flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+    optimize := flags.Bool("O", false, "enable compiler optimizations")
+    flags.Parse(args)
+
+    if flags.NArg() != 1 {
+        return fmt.Errorf("expected one file")
+    }
+
+    opts := compiler.Options{}
+    if *optimize {
+        opts = optimizations
+    }
+
+    bytecode, err := loadFile(flags.Arg(0), opts)
+    if err != nil {
+        return err
+    }
+
+    fmt.Print(compiler.Disassemble(bytecode))
+    return nil
+}
+
+func runStats(args []string) error {
+    flags := flag.NewFlagSet("stats", flag.ExitOnError)
+    optimize := flags.Bool("O", false, "enable compiler optimizations")
+    flags.Parse(args)
+
+    if flags.NArg() != 1 {
+        return fmt.Errorf("expected one file")
+    }
+
+    opts := compiler.Options{}
+    if *optimize {
+        opts = optimizations
+    }
+
+    bytecode, err := loadFile(flags.Arg(0), opts)
+    if err != nil {
+        return err
+    }
+
+    stats, err := code.Measure(bytecode.Instructions, bytecode.Constants)
+    if err != nil {
+        return err
+    }
+
+    fmt.Printf("%d instructions, %d bytes\n\n", stats.Instructions, stats.Bytes)
+
+    // largest share first
+    names := []string{}
+    for name := range stats.Ops {
+        names = append(names, name)
+    }
+    sort.Slice(names, func(i, j int) bool {
+        a, b := stats.Ops[names[i]], stats.Ops[names[j]]
+        if a.Bytes != b.Bytes {
+            return a.Bytes > b.Bytes
+        }
+        return names[i] < names[j]
+    })
+
+    fmt.Printf("%-24s %8s %8s %7s %6s\n", "opcode", "count", "bytes", "share", "wide")
+    for _, name := range names {
+        op := stats.Ops[name]
+        fmt.Printf("%-24s %8d %8d %6.1f%% %6d\n",
+            name, op.Count, op.Bytes, 100 * float64(op.Bytes) / float64(stats.Bytes), op.Wide)
+    }
+
+    types := []string{}
+    for typ := range stats.Constants {
+        types = append(types, string(typ))
+    }
+    sort.Strings(types)
+
+    fmt.Printf("\n%-24s %8s %8s %7s\n", "constants", "count", "bytes", "largest")
+    for _, typ := range types {
+        c := stats.Constants[object.ObjectType(typ)]
+        fmt.Printf("%-24s %8d %8d %7d\n", typ, c.Count, c.Bytes, c.Largest)
+    }
+
+    // how close the operands are to needing OpWide
+    fmt.Printf("\n%-24s %8s %8s\n", "largest operand", "value", "limit")
+    operands := []struct {
+        name string
+        kind code.OperandKind
+    }{
+        {"constant index", code.OperandConstant},
+        {"global index", code.OperandGlobal},
+        {"jump target", code.OperandTarget},
+        {"jump table index", code.OperandTable},
+        {"count", code.OperandNumber},
+    }
+    for _, o := range operands {
+        max := stats.MaxOperands[o.kind]
+        if max < 0 {
+            continue
+        }
+        note := ""
+        if max > code.MaxOperand {
+            note = "  wide"
+        }
+        fmt.Printf("%-24s %8d %8d%s\n", o.name, max, code.MaxOperand, note)
+    }
+    return nil
+}
+
+func runCfg(args []string) error {
+    flags := flag.NewFlagSet("cfg", flag.ExitOnError)
+    optimize := flags.Bool("O", false, "enable compiler optimizations")
+    flags.Parse(args)
+
+    if flags.NArg() != 1 {
+        return fmt.Errorf("expected one source file")
+    }
+
+    opts := compiler.Options{}
+    if *optimize {
+        opts = optimizations
+    }
+
+    bytecode, err := compileFile(flags.Arg(0), opts)
+    if err != nil {
+        return err
+    }
+
+    graph, err := cfg.BuildBytecode(bytecode)
+    if err != nil {
+        return err
+    }
+
+    fmt.Print(graph.Dot())
+    return nil
+}
+
+// Superinstruction candidates are derived from the traces of every program.
+func runSuperinst(args []string) error {
+    flags := flag.NewFlagSet("superinst", flag.ExitOnError)
+    length := flags.Int("n", 3, "length of the opcode sequences")
+    top := flags.Int("top", 10, "number of candidates to print")
+    flags.Parse(args)
+
+    if flags.NArg() == 0 {
+        return fmt.Errorf("expected source files")
+    }
+    if *length < 2 || *length > vm.MaxSequenceLength {
+        return fmt.Errorf("length must be between 2 and %d", vm.MaxSequenceLength)
+    }
+
+    // profile the optimized code, but without already fused opcodes
+    opts := optimizations
+    opts.Superinstructions = false
+
+    profile := vm.NewProfile()
+    for _, path := range flags.Args() {
+        bytecode, err := compileFile(path, opts)
+        if err != nil {
+            return err
+        }
+
+        machine := vm.New(bytecode)
+        machine.SetProfile(profile)
+        err = machine.Run()
+        if err != nil {
+            return fmt.Errorf("%s: %s", path, err)
+        }
+    }
+
+    for i, c := range profile.Candidates(*length) {
+        if i == *top {
+            break
+        }
+        fmt.Printf("%10d  %s\n", c.Count, c)
+    }
+    return nil
+}
+
+// Load a .mbc file, or compile a source file with opts.
+func loadFile(path string, opts compiler.Options) (*compiler.Bytecode, error) {
+    if filepath.Ext(path) == compiler.FileExtension {
+        return compiler.Load(path)
+    }
+    return compileFile(path, opts)
+}
+
+// Parse and compile a source file.
+func compileFile(path string, opts compiler.Options) (*compiler.Bytecode, error) {
+    program, err := parseFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    comp := compiler.New()
+    comp.SetOptions(opts)
+
+    err = comp.Compile(program)
+    if err != nil {
+        return nil, err
+    }
+
+    return comp.Bytecode(), nil
+}
+
+// Parse and compile a source file as a unit named after the file.
+func compileUnitFile(path string, opts compiler.Options) (*compiler.Unit, error) {
+    program, err := parseFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    u, err := compiler.CompileUnit(filepath.Base(path), program, opts)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", path, err)
+    }
+    return u, nil
+}
+
+func parseFile(path string) (*ast.Program, error) {
+    src, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    p := parser.New(lexer.New(string(src)))
+    program := p.ParseProgram()
+    if len(p.Errors()) != 0 {
+        return nil, fmt.Errorf("parse errors:\n\t%s", strings.Join(p.Errors(), "\n\t"))
+    }
+    return program, nil
+}
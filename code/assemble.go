@@ -0,0 +1,271 @@
+package code
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "unicode"
+    "monkey_interpreter/object"
+)
+
+// Assembly is the result of Assemble.
+type Assembly struct {
+    Instructions Instructions
+    Constants []object.Object
+    // label -> offset
+    Labels map[string]int
+    // directives other than .constants and .code, for the caller
+    Directives []Directive
+}
+
+// A directive line like ".handler try catch catch 0", with labels resolved.
+type Directive struct {
+    Name string
+    Args []int
+    Line int
+}
+
+// Assemble parses assembly text:
+//
+//     ; comments run to the end of the line
+//     .constants
+//         0 42
+//         1 "hello"
+//     .code
+//     loop:
+//         OpConst 0
+//         OpJumpNotTruthy done
+//         OpJump loop
+//     done: OpNull
+//
+// Constants are numbered in order and hold Go integer or quoted string
+// literals. An operand is a number or a label. A line may start with an
+// offset, which is ignored, so the output of Instructions.String() reads
+// back. Other directives are passed through in Directives.
+// Operands too large for 2 bytes are made wide like Make does, which moves
+// the labels after them.
+func Assemble(src string) (*Assembly, error) {
+    a := &Assembly{
+        Instructions: Instructions{},
+        Constants: []object.Object{},
+        Labels: make(map[string]int),
+        Directives: []Directive{},
+    }
+
+    items := []*asmItem{}
+    // label -> index of the item it stands before
+    labels := make(map[string]int)
+    section := ".code"
+
+    for n, line := range strings.Split(src, "\n") {
+        lineNo := n + 1
+        line = strings.TrimSpace(stripComment(line))
+        if line == "" {
+            continue
+        }
+
+        if strings.HasPrefix(line, ".") {
+            fields := strings.Fields(line)
+            switch fields[0] {
+            case ".constants", ".code":
+                if len(fields) != 1 {
+                    return nil, fmt.Errorf("line %d: %s takes no arguments", lineNo, fields[0])
+                }
+                section = fields[0]
+            default:
+                items = append(items, &asmItem{directive: fields[0], args: fields[1:], line: lineNo})
+            }
+            continue
+        }
+
+        if section == ".constants" {
+            obj, err := parseConstant(line, len(a.Constants))
+            if err != nil {
+                return nil, fmt.Errorf("line %d: %s", lineNo, err)
+            }
+            a.Constants = append(a.Constants, obj)
+            continue
+        }
+
+        fields := strings.Fields(line)
+        for len(fields) > 0 && strings.HasSuffix(fields[0], ":") {
+            name := strings.TrimSuffix(fields[0], ":")
+            if !isLabel(name) {
+                return nil, fmt.Errorf("line %d: invalid label %q", lineNo, name)
+            }
+            if _, ok := labels[name]; ok {
+                return nil, fmt.Errorf("line %d: label %s defined twice", lineNo, name)
+            }
+            labels[name] = len(items)
+            fields = fields[1:]
+        }
+        if len(fields) > 0 && isNumber(fields[0]) {
+            fields = fields[1:]
+        }
+        if len(fields) == 0 {
+            continue
+        }
+
+        op, ok := opcodesByName[fields[0]]
+        if !ok || op == OpWide {
+            return nil, fmt.Errorf("line %d: unknown opcode %s", lineNo, fields[0])
+        }
+        def := definitions[op]
+        if len(fields) - 1 != len(def.OperandWidths) {
+            return nil, fmt.Errorf("line %d: %s takes %d operands, got %d",
+                lineNo, def.Name, len(def.OperandWidths), len(fields) - 1)
+        }
+        items = append(items, &asmItem{op: op, args: fields[1:], line: lineNo})
+    }
+
+    for _, item := range items {
+        for _, arg := range item.args {
+            if isLabel(arg) {
+                if _, ok := labels[arg]; !ok {
+                    return nil, fmt.Errorf("line %d: undefined label %s", item.line, arg)
+                }
+            }
+        }
+    }
+
+    // Sizes depend on the label offsets and the offsets on the sizes.
+    // Start from normal operands and grow until nothing changes.
+    offsets := make([]int, len(items) + 1)
+    resolve := func(item *asmItem) ([]int, error) {
+        values := make([]int, len(item.args))
+        for i, arg := range item.args {
+            if isLabel(arg) {
+                values[i] = offsets[labels[arg]]
+                continue
+            }
+            v, err := strconv.ParseInt(arg, 0, 64)
+            if err != nil {
+                return nil, fmt.Errorf("line %d: invalid operand %s", item.line, arg)
+            }
+            values[i] = int(v)
+        }
+        return values, nil
+    }
+
+    for changed := true; changed; {
+        changed = false
+        pos := 0
+        for i, item := range items {
+            offsets[i] = pos
+            pos += item.size
+        }
+        offsets[len(items)] = pos
+
+        for _, item := range items {
+            if item.directive != "" {
+                continue
+            }
+            operands, err := resolve(item)
+            if err != nil {
+                return nil, err
+            }
+            if err := CheckOperands(item.op, operands...); err != nil {
+                return nil, fmt.Errorf("line %d: %s", item.line, err)
+            }
+            if size := len(Make(item.op, operands...)); size > item.size {
+                item.size = size
+                changed = true
+            }
+        }
+    }
+
+    for _, item := range items {
+        values, err := resolve(item)
+        if err != nil {
+            return nil, err
+        }
+        if item.directive != "" {
+            a.Directives = append(a.Directives, Directive{Name: item.directive, Args: values, Line: item.line})
+            continue
+        }
+        a.Instructions = append(a.Instructions, Make(item.op, values...)...)
+    }
+
+    for name, i := range labels {
+        a.Labels[name] = offsets[i]
+    }
+
+    return a, nil
+}
+
+// An instruction or a directive, with its operands still as text.
+type asmItem struct {
+    op Opcode
+    directive string
+    args []string
+    line int
+    // bytes taken so far, directives take none
+    size int
+}
+
+var opcodesByName = func() map[string]Opcode {
+    m := make(map[string]Opcode)
+    for op, def := range definitions {
+        m[def.Name] = op
+    }
+    return m
+}()
+
+// The line without its ; comment. A ; inside a quoted string is kept.
+func stripComment(line string) string {
+    quoted := false
+    for i := 0; i < len(line); i++ {
+        switch {
+        case quoted && line[i] == '\\':
+            i++
+        case line[i] == '"':
+            quoted = !quoted
+        case !quoted && line[i] == ';':
+            return line[:i]
+        }
+    }
+    return line
+}
+
+// "<index> <literal>", the index has to be the next one.
+func parseConstant(line string, next int) (object.Object, error) {
+    fields := strings.Fields(line)
+    if len(fields) < 2 {
+        return nil, fmt.Errorf("expected an index and a constant")
+    }
+    index, err := strconv.Atoi(strings.TrimSuffix(fields[0], ":"))
+    if err != nil || index != next {
+        return nil, fmt.Errorf("expected constant %d, got %s", next, fields[0])
+    }
+
+    // the rest of the line, spaces inside a string included
+    literal := strings.TrimSpace(line[len(fields[0]):])
+    if strings.HasPrefix(literal, "\"") {
+        s, err := strconv.Unquote(literal)
+        if err != nil {
+            return nil, fmt.Errorf("invalid string %s", literal)
+        }
+        return &object.String{Value: s}, nil
+    }
+
+    v, err := strconv.ParseInt(literal, 0, 64)
+    if err != nil {
+        return nil, fmt.Errorf("invalid constant %s", literal)
+    }
+    return &object.Integer{Value: v}, nil
+}
+
+func isLabel(s string) bool {
+    for i, r := range s {
+        if r == '_' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r)) {
+            continue
+        }
+        return false
+    }
+    return s != ""
+}
+
+func isNumber(s string) bool {
+    _, err := strconv.Atoi(s)
+    return err == nil
+}
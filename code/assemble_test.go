@@ -0,0 +1,195 @@
+package code
+
+import (
+    "strings"
+    "testing"
+    "monkey_interpreter/object"
+)
+
+func TestAssemble(t *testing.T) {
+    src := `
+; the constants come first
+.constants
+    0 42
+    1 "a; \"b\""
+.code
+start:
+    OpConst 0
+    OpJumpNotTruthy else   ; forward
+    OpConst 1
+    OpJump end
+else: OpNull
+end:
+    OpPop
+    OpJump start           ; backward
+`
+    a, err := Assemble(src)
+    if err != nil {
+        t.Fatalf("assemble error: %s", err)
+    }
+
+    expected := concat(
+        Make(OpConst, 0),
+        Make(OpJumpNotTruthy, 12),
+        Make(OpConst, 1),
+        Make(OpJump, 13),
+        Make(OpNull),
+        Make(OpPop),
+        Make(OpJump, 0),
+    )
+    if a.Instructions.String() != expected.String() {
+        t.Errorf("wrong instructions.\nwant=%s\ngot=%s", expected, a.Instructions)
+    }
+
+    if len(a.Constants) != 2 {
+        t.Fatalf("wrong number of constants. got=%d", len(a.Constants))
+    }
+    if i, ok := a.Constants[0].(*object.Integer); !ok || i.Value != 42 {
+        t.Errorf("wrong constant 0. got=%s", a.Constants[0].Inspect())
+    }
+    if s, ok := a.Constants[1].(*object.String); !ok || s.Value != `a; "b"` {
+        t.Errorf("wrong constant 1. got=%s", a.Constants[1].Inspect())
+    }
+
+    labels := map[string]int{"start": 0, "else": 12, "end": 13}
+    for name, want := range labels {
+        if a.Labels[name] != want {
+            t.Errorf("wrong offset of %s. want=%d, got=%d", name, want, a.Labels[name])
+        }
+    }
+}
+
+// The disassembly reads back to the same instructions.
+func TestAssembleDisassembly(t *testing.T) {
+    ins := concat(
+        Make(OpGetGlobal, 1),
+        Make(OpConst, 65536),
+        Make(OpGetGlobalConstAdd, 2, 3),
+        Make(OpJumpNotTruthy, 0),
+        Make(OpHash, 4),
+        Make(OpThrow),
+    )
+
+    a, err := Assemble(ins.String())
+    if err != nil {
+        t.Fatalf("assemble error: %s", err)
+    }
+    if string(a.Instructions) != string(ins) {
+        t.Errorf("wrong instructions.\nwant=%s\ngot=%s", ins, a.Instructions)
+    }
+}
+
+func TestAssembleWideLabels(t *testing.T) {
+    // the jump target moves past 65535 once the jump itself is wide
+    var src strings.Builder
+    src.WriteString("OpJump end\n")
+    for i := 0; i < 65533; i++ {
+        src.WriteString("OpPop\n")
+    }
+    src.WriteString("end: OpNull\n")
+
+    a, err := Assemble(src.String())
+    if err != nil {
+        t.Fatalf("assemble error: %s", err)
+    }
+    if a.Labels["end"] != 65539 {
+        t.Errorf("wrong offset of end. want=65539, got=%d", a.Labels["end"])
+    }
+    op, operands, width, err := ReadInstruction(a.Instructions)
+    if err != nil || op != OpJump || width != 6 || operands[0] != 65539 {
+        t.Errorf("expected a wide jump to 65539. got=%d %v (%d bytes), %v", op, operands, width, err)
+    }
+}
+
+func TestAssembleDirectives(t *testing.T) {
+    a, err := Assemble(".handler try end catch 0\ntry: OpThrow\nend:\ncatch: OpPop\n.table -1 end try catch")
+    if err != nil {
+        t.Fatalf("assemble error: %s", err)
+    }
+
+    expected := []Directive{
+        {Name: ".handler", Args: []int{0, 1, 1, 0}, Line: 1},
+        {Name: ".table", Args: []int{-1, 1, 0, 1}, Line: 5},
+    }
+    if len(a.Directives) != len(expected) {
+        t.Fatalf("wrong number of directives. got=%d", len(a.Directives))
+    }
+    for i, d := range expected {
+        got := a.Directives[i]
+        if got.Name != d.Name || got.Line != d.Line || len(got.Args) != len(d.Args) {
+            t.Errorf("wrong directive %d. want=%v, got=%v", i, d, got)
+            continue
+        }
+        for j := range d.Args {
+            if got.Args[j] != d.Args[j] {
+                t.Errorf("wrong directive %d. want=%v, got=%v", i, d, got)
+            }
+        }
+    }
+}
+
+func TestAssembleComments(t *testing.T) {
+    src := `.constants
+0 "x" ; note
+1 "a;b" ; a ; inside the string
+2 "say \"hi;\"" ; escaped quotes
+3 7;no space
+4	"tab"
+5 	 8
+.code
+OpConst 0 ; "quoted" in a comment`
+
+    a, err := Assemble(src)
+    if err != nil {
+        t.Fatalf("assemble error: %s", err)
+    }
+
+    expected := []string{"x", "a;b", `say "hi;"`, "7", "tab", "8"}
+    if len(a.Constants) != len(expected) {
+        t.Fatalf("wrong number of constants. want=%d, got=%d", len(expected), len(a.Constants))
+    }
+    for i, want := range expected {
+        if got := a.Constants[i].Inspect(); got != want {
+            t.Errorf("wrong constant %d. want=%q, got=%q", i, want, got)
+        }
+    }
+    if string(a.Instructions) != string(Make(OpConst, 0)) {
+        t.Errorf("wrong instructions. got=%s", a.Instructions)
+    }
+}
+
+func TestAssembleErrors(t *testing.T) {
+    tests := []struct {
+        src string
+        expected string
+    }{
+        {"OpFoo", "line 1: unknown opcode OpFoo"},
+        {"OpWide", "line 1: unknown opcode OpWide"},
+        {"OpConst", "line 1: OpConst takes 1 operands, got 0"},
+        {"OpPop 1", "line 1: OpPop takes 0 operands, got 1"},
+        {"\nOpJump nowhere", "line 2: undefined label nowhere"},
+        {"a: OpPop\na: OpPop", "line 2: label a defined twice"},
+        {"OpConst -1", "line 1: operand -1 of OpConst out of range"},
+        {"OpConst x1y", "line 1: undefined label x1y"},
+        {"OpConst 1.5", "line 1: invalid operand 1.5"},
+        {".constants\n1 2", "line 2: expected constant 0, got 1"},
+        {".constants\n0 \"open", "line 2: invalid string \"open"},
+        {".constants\n0 true", "line 2: invalid constant true"},
+        {".code 1", "line 1: .code takes no arguments"},
+    }
+
+    for _, test := range tests {
+        _, err := Assemble(test.src)
+        if err == nil || err.Error() != test.expected {
+            t.Errorf("wrong error for %q. want=%q, got=%v", test.src, test.expected, err)
+        }
+    }
+}
+
+func concat(insts ...[]byte) Instructions {
+    out := Instructions{}
+    for _, ins := range insts {
+        out = append(out, ins...)
+    }
+    return out
+}
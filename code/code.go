@@ -4,6 +4,7 @@ import (
     "encoding/binary"
     "fmt"
     "bytes"
+    "hash/crc32"
 )
 
 type Opcode byte
@@ -30,6 +31,13 @@ const (
     OpHash
     OpIndex
     OpNull
+    OpThrow
+    OpJumpTable
+    OpConcat
+    OpGetGlobalConstAdd
+    OpConstGT
+    OpGetGlobalIndex
+    OpWide
 )
 
 type Instructions []byte
@@ -37,32 +45,149 @@ type Instructions []byte
 type Definition struct {
     Name string
     OperandWidths []int
+    // what each operand refers to, nil when they are plain numbers
+    OperandKinds []OperandKind
+    // Values taken from and left on the stack when execution goes on with
+    // the next instruction, see StackEffect.
+    Pops int
+    Pushes int
+    // Values taken when a Branch opcode goes elsewhere, it pushes none then.
+    BranchPops int
+    Flags Flags
+    Category Category
 }
 
+// What an opcode does besides moving values on the stack.
+type Flags uint8
+
+const (
+    // may go on somewhere other than the next instruction
+    Branch Flags = 1 << iota
+    // the first operand is an absolute jump target
+    Jump
+    // never goes on with the next instruction
+    NoFallthrough
+    // may leave for a handler, with a runtime error or a thrown value
+    Throws
+    // changes state other than the stack
+    SideEffect
+    // the first operand is the number of values popped
+    PopsOperand
+)
+
+// What an operand refers to, for tools that relocate them.
+type OperandKind int
+
+const (
+    // a count or other plain number
+    OperandNumber OperandKind = iota
+    // an index into the constant pool
+    OperandConstant
+    // a global index
+    OperandGlobal
+    // an absolute jump target
+    OperandTarget
+    // an index into the jump tables
+    OperandTable
+)
+
+type Category string
+
+const (
+    CategoryStack Category = "stack"
+    CategoryGlobal Category = "global"
+    CategoryOperator Category = "operator"
+    CategoryData Category = "data"
+    CategoryControl Category = "control"
+    CategorySuperinstruction Category = "superinstruction"
+    CategoryPrefix Category = "prefix"
+)
+
 var definitions = map[Opcode]*Definition {
-    OpConst: {"OpConst", []int{2}},
-    OpGetGlobal: {"OpGetGlobal", []int{2}},
-    OpSetGlobal: {"OpSetGlobal", []int{2}},
-    OpAdd: {"OpAdd", []int{}},
-    OpSub: {"OpSub", []int{}},
-    OpMul: {"OpMul", []int{}},
-    OpDiv: {"OpDiv", []int{}},
-    OpPop: {"OpPop", []int{}},
-    OpTrue: {"OpTrue", []int{}},
-    OpFalse: {"OpFalse", []int{}},
-    OpEq: {"OpEq", []int{}},
-    OpNE: {"OpNE", []int{}},
-    OpGT: {"OpGT", []int{}},
-    OpMinus: {"OpMinus", []int{}},
-    OpBang: {"OpBang", []int{}},
-    OpJumpNotTruthy: {"OpJumpNotTruthy", []int{2}},
-    OpJump: {"OpJump", []int{2}},
-    OpArray: {"OpArray", []int{2}},
-    OpHash: {"OpHash", []int{2}},
-    OpIndex: {"OpIndex", []int{}},
-    OpNull: {"OpNull", []int{}},
+    OpConst: {Name: "OpConst", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandConstant}, Pushes: 1, Category: CategoryStack},
+    OpGetGlobal: {Name: "OpGetGlobal", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandGlobal}, Pushes: 1, Category: CategoryGlobal},
+    OpSetGlobal: {Name: "OpSetGlobal", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandGlobal}, Pops: 1, Flags: SideEffect, Category: CategoryGlobal},
+    OpAdd: {Name: "OpAdd", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpSub: {Name: "OpSub", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpMul: {Name: "OpMul", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpDiv: {Name: "OpDiv", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpPop: {Name: "OpPop", OperandWidths: []int{}, Pops: 1, Category: CategoryStack},
+    OpTrue: {Name: "OpTrue", OperandWidths: []int{}, Pushes: 1, Category: CategoryStack},
+    OpFalse: {Name: "OpFalse", OperandWidths: []int{}, Pushes: 1, Category: CategoryStack},
+    OpEq: {Name: "OpEq", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpNE: {Name: "OpNE", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpGT: {Name: "OpGT", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpMinus: {Name: "OpMinus", OperandWidths: []int{}, Pops: 1, Pushes: 1, Flags: Throws, Category: CategoryOperator},
+    OpBang: {Name: "OpBang", OperandWidths: []int{}, Pops: 1, Pushes: 1, Category: CategoryOperator},
+    OpJumpNotTruthy: {Name: "OpJumpNotTruthy", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandTarget}, Pops: 1, BranchPops: 1, Flags: Branch | Jump, Category: CategoryControl},
+    OpJump: {Name: "OpJump", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandTarget}, Flags: Branch | Jump | NoFallthrough, Category: CategoryControl},
+    OpArray: {Name: "OpArray", OperandWidths: []int{2}, Pushes: 1, Flags: PopsOperand, Category: CategoryData},
+    OpHash: {Name: "OpHash", OperandWidths: []int{2}, Pushes: 1, Flags: PopsOperand | Throws, Category: CategoryData},
+    OpIndex: {Name: "OpIndex", OperandWidths: []int{}, Pops: 2, Pushes: 1, Flags: Throws, Category: CategoryData},
+    OpNull: {Name: "OpNull", OperandWidths: []int{}, Pushes: 1, Category: CategoryStack},
+    OpThrow: {Name: "OpThrow", OperandWidths: []int{}, Pops: 1, Flags: NoFallthrough | Throws, Category: CategoryControl},
+    // the operand is an index into Bytecode.JumpTables
+    OpJumpTable: {Name: "OpJumpTable", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandTable}, BranchPops: 1, Flags: Branch | NoFallthrough, Category: CategoryControl},
+    OpConcat: {Name: "OpConcat", OperandWidths: []int{2}, Pushes: 1, Flags: PopsOperand, Category: CategoryData},
+    OpGetGlobalConstAdd: {Name: "OpGetGlobalConstAdd", OperandWidths: []int{2, 2}, OperandKinds: []OperandKind{OperandGlobal, OperandConstant}, Pushes: 1, Flags: Throws, Category: CategorySuperinstruction},
+    OpConstGT: {Name: "OpConstGT", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandConstant}, Pops: 1, Pushes: 1, Flags: Throws, Category: CategorySuperinstruction},
+    OpGetGlobalIndex: {Name: "OpGetGlobalIndex", OperandWidths: []int{2}, OperandKinds: []OperandKind{OperandGlobal}, Pops: 1, Pushes: 1, Flags: Throws, Category: CategorySuperinstruction},
+    // prefix: every operand of the next instruction is 4 bytes wide
+    OpWide: {Name: "OpWide", OperandWidths: []int{}, Category: CategoryPrefix},
+}
+
+// Values popped and pushed by an instruction of def with these operands,
+// when execution goes on with the next instruction.
+func (def *Definition) StackEffect(operands []int) (pops, pushes int) {
+    pops = def.Pops
+    if def.Flags&PopsOperand != 0 && len(operands) > 0 {
+        pops = operands[0]
+    }
+    return pops, def.Pushes
+}
+
+// The kind of operand i of def.
+func (def *Definition) OperandKind(i int) OperandKind {
+    if i < len(def.OperandKinds) {
+        return def.OperandKinds[i]
+    }
+    return OperandNumber
 }
 
+// Whether op is defined and has all of flags.
+func Has(op Opcode, flags Flags) bool {
+    def, ok := definitions[op]
+    return ok && def.Flags&flags == flags
+}
+
+// Fingerprint of the opcode table: the numbers, names and operand widths
+// of the opcodes. Serialized bytecode records it, since adding or moving
+// an opcode renumbers the ones after it.
+func Fingerprint() uint32 {
+    return fingerprint
+}
+
+var fingerprint = crc32.ChecksumIEEE([]byte(opcodeTable()))
+
+// One line per opcode: "number name widths".
+func opcodeTable() string {
+    var out bytes.Buffer
+    for op := 0; op < 256; op++ {
+        def, ok := definitions[Opcode(op)]
+        if !ok {
+            continue
+        }
+        fmt.Fprintf(&out, "%d %s %v\n", op, def.Name, def.OperandWidths)
+    }
+    return out.String()
+}
+
+// Largest operand of the normal and of the wide encoding.
+const (
+    MaxOperand = 1<<16 - 1
+    MaxWideOperand = 1<<32 - 1
+)
+
 func Lookup(op byte) (*Definition, error) {
     def, ok := definitions[Opcode(op)]
     if !ok {
@@ -73,72 +198,139 @@ func Lookup(op byte) (*Definition, error) {
 }
 
 // operatorとoperandをbytecodeの命令列へencodeする
+// An operand too large for its width makes the whole instruction wide:
+// OpWide, then op with 4-byte operands. An operand that doesn't fit even
+// then gives an empty instruction, see CheckOperands.
 func Make(op Opcode, operands ...int) []byte {
     def, ok := definitions[op]
     if !ok {
         return []byte{}
     }
+    if CheckOperands(op, operands...) != nil {
+        return []byte{}
+    }
 
-    instLen := 1
-    for _, w := range def.OperandWidths {
-        instLen += w
+    wide := false
+    for _, operand := range operands {
+        if operand > MaxOperand {
+            wide = true
+        }
     }
 
+    w := OperandWidth(wide)
+    instLen := 1 + len(def.OperandWidths) * w
+
     // 命令バイト列の生成
     inst := make([]byte, instLen)
     inst[0] = byte(op)
 
     offset := 1
-    for i, operand := range operands {
-        w := def.OperandWidths[i]
+    for _, operand := range operands {
         switch w {
         case 2:
             binary.BigEndian.PutUint16(inst[offset:], uint16(operand))
+        case 4:
+            binary.BigEndian.PutUint32(inst[offset:], uint32(operand))
         }
         offset += w
     }
 
+    if wide {
+        return append([]byte{byte(OpWide)}, inst...)
+    }
     return inst
 }
 
-//　bytecodeの命令列からoperandのスライスへdecodeする
-func ReadOperands(def *Definition, ins Instructions) ([]int, int) {
-    ow := def.OperandWidths
-    operands := make([]int, len(ow))
+// Whether op with these operands can be encoded at all.
+func CheckOperands(op Opcode, operands ...int) error {
+    def, ok := definitions[op]
+    if !ok {
+        return fmt.Errorf("opcode %d undefined", op)
+    }
+    if len(operands) > len(def.OperandWidths) {
+        return fmt.Errorf("%s takes %d operands, got %d", def.Name, len(def.OperandWidths), len(operands))
+    }
 
-    offset := 0
-    for i, width := range def.OperandWidths {
-        switch width {
-        case 2:
-            operands[i] = int(ReadUint16(ins[offset:]))
+    for _, operand := range operands {
+        if operand < 0 || operand > MaxWideOperand {
+            return fmt.Errorf("operand %d of %s out of range", operand, def.Name)
         }
-        offset += width
     }
-
-    return operands, offset
+    return nil
 }
 
 func ReadUint16(ins Instructions) uint16 {
     return binary.BigEndian.Uint16(ins)
 }
 
-func (ins Instructions)String() string {
-    var out bytes.Buffer
+func ReadUint32(ins Instructions) uint32 {
+    return binary.BigEndian.Uint32(ins)
+}
 
-    i := 0
-    for i < len(ins) {
-        def, err := Lookup(ins[i])
-        if err != nil {
-            fmt.Fprintf(&out, "ERROR: %s\n", err)
-            continue
+// Every operand is 2 bytes, 4 in an instruction with the OpWide prefix.
+func OperandWidth(wide bool) int {
+    if wide {
+        return 4
+    }
+    return 2
+}
+
+// The operand at pos of an instruction with or without the OpWide prefix.
+func ReadOperand(ins Instructions, pos int, wide bool) int {
+    if wide {
+        return int(ReadUint32(ins[pos:]))
+    }
+    return int(ReadUint16(ins[pos:]))
+}
+
+// Decode the instruction at the start of ins, with its OpWide prefix if
+// there is one. width is the number of bytes it takes.
+func ReadInstruction(ins Instructions) (op Opcode, operands []int, width int, err error) {
+    wide := len(ins) > 0 && Opcode(ins[0]) == OpWide
+    if wide {
+        ins = ins[1:]
+        width = 1
+    }
+    if len(ins) == 0 {
+        return 0, nil, 0, fmt.Errorf("missing opcode")
+    }
+
+    op = Opcode(ins[0])
+    def, err := Lookup(ins[0])
+    if err != nil {
+        return 0, nil, 0, err
+    }
+    if wide && (op == OpWide || len(def.OperandWidths) == 0) {
+        return 0, nil, 0, fmt.Errorf("OpWide before %s", def.Name)
+    }
+
+    operands = make([]int, len(def.OperandWidths))
+    offset := 1
+    w := OperandWidth(wide)
+    for i := range def.OperandWidths {
+        if offset + w > len(ins) {
+            return 0, nil, 0, fmt.Errorf("%s truncated", def.Name)
         }
+        operands[i] = ReadOperand(ins, offset, wide)
+        offset += w
+    }
 
-        // 1byte分のoperatorは飛ばす
-        operands, read_n := ReadOperands(def, ins[i+1:])
+    return op, operands, width + offset, nil
+}
 
-        fmt.Fprintf(&out, "%04d %s\n", i, ins.fmtInstruction(def, operands))
+// A wide instruction is printed under its own name. Decoding stops at the
+// first error, which ends the output.
+func (ins Instructions)String() string {
+    var out bytes.Buffer
 
-        i += 1 + read_n
+    d := NewDecoder(ins)
+    for d.Next() {
+        inst := d.Instruction()
+        def, _ := Lookup(byte(inst.Op))
+        fmt.Fprintf(&out, "%04d %s\n", inst.Offset, ins.fmtInstruction(def, inst.Operands))
+    }
+    if err := d.Err(); err != nil {
+        fmt.Fprintf(&out, "ERROR: %s\n", err)
     }
 
     return out.String()
@@ -152,12 +344,9 @@ func (ins Instructions)fmtInstruction(def *Definition, operands []int) string {
             len(operands), operandCount)
     }
 
-    switch operandCount {
-    case 0:
-        return def.Name
-    case 1:
-        return fmt.Sprintf("%s %d", def.Name, operands[0])
+    out := def.Name
+    for _, operand := range operands {
+        out += fmt.Sprintf(" %d", operand)
     }
-
-    return fmt.Sprintf("ERROR: unhandled operandCount for %s\n", def.Name)
+    return out
 }
@@ -1,6 +1,9 @@
 package code
 
-import "testing"
+import (
+    "hash/crc32"
+    "testing"
+)
 
 func TestMake(t *testing.T) {
     tests := []struct {
@@ -10,6 +13,9 @@ func TestMake(t *testing.T) {
     }{
         {OpConst, []int{65534}, []byte{byte(OpConst), 255, 254}},
         {OpAdd, []int{}, []byte{byte(OpAdd)}},
+        {OpConst, []int{65536}, []byte{byte(OpWide), byte(OpConst), 0, 1, 0, 0}},
+        // one large operand makes both wide
+        {OpGetGlobalConstAdd, []int{1, 70000}, []byte{byte(OpWide), byte(OpGetGlobalConstAdd), 0, 0, 0, 1, 0, 1, 17, 112}},
     }
 
     for _, test := range tests {
@@ -32,11 +38,15 @@ func TestInstsString(t *testing.T) {
         Make(OpAdd),
         Make(OpConst, 2),
         Make(OpConst, 65534),
+        Make(OpConst, 65536),
+        Make(OpPop),
     }
 
     expected := `0000 OpAdd
 0001 OpConst 2
 0004 OpConst 65534
+0007 OpConst 65536
+0013 OpPop
 `
 
     concatted := Instructions{}
@@ -49,32 +59,175 @@ func TestInstsString(t *testing.T) {
     }
 }
 
-func TestReadOperands(t *testing.T) {
+func TestReadInstruction(t *testing.T) {
     tests := []struct {
+        ins []byte
         op Opcode
         operands []int
-        bytesRead int
+        width int
     }{
-        {OpConst, []int{65535}, 2},
+        {Make(OpConst, 65535), OpConst, []int{65535}, 3},
+        {Make(OpJump, 100000), OpJump, []int{100000}, 6},
+        {Make(OpGetGlobalConstAdd, 70000, 2), OpGetGlobalConstAdd, []int{70000, 2}, 10},
+        {Make(OpPop), OpPop, []int{}, 1},
     }
 
     for _, test := range tests {
-        inst := Make(test.op, test.operands...)
-
-        def, err := Lookup(byte(test.op))
+        op, operands, width, err := ReadInstruction(test.ins)
         if err != nil {
-            t.Fatalf("defnition not found")
+            t.Fatalf("unexpected error: %s", err)
+        }
+        if op != test.op || width != test.width {
+            t.Errorf("wrong instruction. want=%d (%d bytes), got=%d (%d bytes)", test.op, test.width, op, width)
+        }
+        for i, want := range test.operands {
+            if operands[i] != want {
+                t.Errorf("wrong operand %d. want=%d, got=%d", i, want, operands[i])
+            }
         }
+    }
 
-        operandsRead, n := ReadOperands(def, inst[1:])
-        if n != test.bytesRead {
-            t.Fatalf("n wrong")
+    bad := [][]byte{
+        {byte(OpWide), byte(OpPop)},
+        {byte(OpWide), byte(OpWide), byte(OpConst), 0, 0, 0, 1},
+        {byte(OpWide), byte(OpConst), 0, 1},
+        {byte(OpWide)},
+    }
+    for _, ins := range bad {
+        _, _, _, err := ReadInstruction(ins)
+        if err == nil {
+            t.Errorf("expected an error for %v", ins)
         }
+    }
+}
 
-        for i, want := range test.operands {
-            if operandsRead[i] != want {
-                t.Errorf("operand wrong")
+func TestCheckOperands(t *testing.T) {
+    if err := CheckOperands(OpConst, MaxWideOperand); err != nil {
+        t.Errorf("unexpected error: %s", err)
+    }
+    if err := CheckOperands(OpConst, MaxWideOperand + 1); err == nil {
+        t.Errorf("expected an error for an operand past MaxWideOperand")
+    }
+    if err := CheckOperands(OpConst, -1); err == nil {
+        t.Errorf("expected an error for a negative operand")
+    }
+}
+
+func TestDefinitions(t *testing.T) {
+    for op := OpConst; op <= OpWide; op++ {
+        def, ok := definitions[op]
+        if !ok {
+            t.Errorf("opcode %d undefined", op)
+            continue
+        }
+        if def.Flags&Jump != 0 && (def.Flags&Branch == 0 || len(def.OperandWidths) == 0) {
+            t.Errorf("%s: a jump must branch and have a target operand", def.Name)
+        }
+        if def.Flags&PopsOperand != 0 && (def.Pops != 0 || len(def.OperandWidths) == 0) {
+            t.Errorf("%s: the pop count must come from the first operand only", def.Name)
+        }
+        if def.BranchPops != 0 && def.Flags&Branch == 0 {
+            t.Errorf("%s: BranchPops without Branch", def.Name)
+        }
+        if len(def.OperandKinds) > len(def.OperandWidths) {
+            t.Errorf("%s: more operand kinds than operands", def.Name)
+        }
+        if (def.Flags&Jump != 0) != (def.OperandKind(0) == OperandTarget) {
+            t.Errorf("%s: the Jump flag and the kind of the first operand disagree", def.Name)
+        }
+        for _, w := range def.OperandWidths {
+            if w != OperandWidth(false) {
+                t.Errorf("%s: a %d byte operand, operands are %d bytes", def.Name, w, OperandWidth(false))
+            }
+        }
+        for i := 1; i < len(def.OperandKinds); i++ {
+            if def.OperandKinds[i] == OperandTarget {
+                t.Errorf("%s: only the first operand can be a jump target", def.Name)
             }
         }
+        if def.Category == "" {
+            t.Errorf("%s: no category", def.Name)
+        }
+    }
+}
+
+func TestStackEffect(t *testing.T) {
+    tests := []struct {
+        op Opcode
+        operands []int
+        pops int
+        pushes int
+    }{
+        {OpConst, []int{7}, 0, 1},
+        {OpAdd, []int{}, 2, 1},
+        {OpSetGlobal, []int{0}, 1, 0},
+        {OpArray, []int{3}, 3, 1},
+        {OpHash, []int{4}, 4, 1},
+        {OpConcat, []int{0}, 0, 1},
+        {OpJumpNotTruthy, []int{10}, 1, 0},
+    }
+
+    for _, test := range tests {
+        pops, pushes := definitions[test.op].StackEffect(test.operands)
+        if pops != test.pops || pushes != test.pushes {
+            t.Errorf("wrong stack effect of %s %v. want=(%d, %d), got=(%d, %d)",
+                definitions[test.op].Name, test.operands, test.pops, test.pushes, pops, pushes)
+        }
+    }
+
+    if !Has(OpJump, Jump | NoFallthrough) || Has(OpJumpTable, Jump) || Has(Opcode(255), 0) {
+        t.Errorf("wrong flags")
+    }
+}
+
+// Golden opcode table. When this fails, the opcode numbers or encodings
+// changed and every saved .mbc file stops loading: if that is intended,
+// update both constants below.
+func TestFingerprint(t *testing.T) {
+    expectedTable := `0 OpConst [2]
+1 OpGetGlobal [2]
+2 OpSetGlobal [2]
+3 OpAdd []
+4 OpSub []
+5 OpMul []
+6 OpDiv []
+7 OpPop []
+8 OpTrue []
+9 OpFalse []
+10 OpEq []
+11 OpNE []
+12 OpGT []
+13 OpMinus []
+14 OpBang []
+15 OpJumpNotTruthy [2]
+16 OpJump [2]
+17 OpArray [2]
+18 OpHash [2]
+19 OpIndex []
+20 OpNull []
+21 OpThrow []
+22 OpJumpTable [2]
+23 OpConcat [2]
+24 OpGetGlobalConstAdd [2 2]
+25 OpConstGT [2]
+26 OpGetGlobalIndex [2]
+27 OpWide []
+`
+    const expectedFingerprint = 0x2ab011b2
+
+    if table := opcodeTable(); table != expectedTable {
+        t.Errorf("the opcode table changed.\nwant=%s\ngot=%s", expectedTable, table)
+    }
+    if Fingerprint() != expectedFingerprint {
+        t.Errorf("wrong fingerprint. want=%08x, got=%08x", expectedFingerprint, Fingerprint())
+    }
+
+    // two opcodes trading places is caught too
+    definitions[OpAdd], definitions[OpSub] = definitions[OpSub], definitions[OpAdd]
+    defer func() {
+        definitions[OpAdd], definitions[OpSub] = definitions[OpSub], definitions[OpAdd]
+    }()
+    if crc32.ChecksumIEEE([]byte(opcodeTable())) == Fingerprint() {
+        t.Errorf("swapping OpAdd and OpSub kept the fingerprint")
     }
 }
@@ -0,0 +1,77 @@
+package code
+
+import (
+    "fmt"
+)
+
+// An instruction decoded from Instructions.
+type Instruction struct {
+    // position of the first byte, the OpWide prefix if there is one
+    Offset int
+    Op Opcode
+    Operands []int
+    // bytes taken, with the prefix
+    Width int
+}
+
+// Decoder reads the instructions one after another:
+//
+//     d := code.NewDecoder(ins)
+//     for d.Next() {
+//         inst := d.Instruction()
+//         ...
+//     }
+//     if err := d.Err(); err != nil {
+//         ...
+//     }
+//
+// It stops at the first instruction it can't decode.
+type Decoder struct {
+    ins Instructions
+    offset int
+    inst Instruction
+    err error
+}
+
+func NewDecoder(ins Instructions) *Decoder {
+    return &Decoder{ins: ins}
+}
+
+// Decode the next instruction. false at the end and after an error.
+func (d *Decoder) Next() bool {
+    if d.err != nil || d.offset >= len(d.ins) {
+        return false
+    }
+
+    op, operands, width, err := ReadInstruction(d.ins[d.offset:])
+    if err != nil {
+        d.err = fmt.Errorf("at %04d: %s", d.offset, err)
+        return false
+    }
+
+    d.inst = Instruction{Offset: d.offset, Op: op, Operands: operands, Width: width}
+    d.offset += width
+    return true
+}
+
+// The instruction decoded by the last Next.
+func (d *Decoder) Instruction() Instruction {
+    return d.inst
+}
+
+// The error that stopped the decoder, nil at the end of the instructions.
+func (d *Decoder) Err() error {
+    return d.err
+}
+
+// Every instruction in ins.
+func Decode(ins Instructions) ([]Instruction, error) {
+    insts := []Instruction{}
+
+    d := NewDecoder(ins)
+    for d.Next() {
+        insts = append(insts, d.Instruction())
+    }
+
+    return insts, d.Err()
+}
@@ -0,0 +1,80 @@
+package code
+
+import (
+    "testing"
+)
+
+func TestDecoder(t *testing.T) {
+    ins := concat(
+        Make(OpConst, 1),
+        Make(OpGetGlobalConstAdd, 70000, 2),
+        Make(OpPop),
+    )
+
+    expected := []Instruction{
+        {Offset: 0, Op: OpConst, Operands: []int{1}, Width: 3},
+        {Offset: 3, Op: OpGetGlobalConstAdd, Operands: []int{70000, 2}, Width: 10},
+        {Offset: 13, Op: OpPop, Operands: []int{}, Width: 1},
+    }
+
+    insts, err := Decode(ins)
+    if err != nil {
+        t.Fatalf("decode error: %s", err)
+    }
+    if len(insts) != len(expected) {
+        t.Fatalf("wrong number of instructions. want=%d, got=%d", len(expected), len(insts))
+    }
+    for i, want := range expected {
+        got := insts[i]
+        if got.Offset != want.Offset || got.Op != want.Op || got.Width != want.Width ||
+            len(got.Operands) != len(want.Operands) {
+            t.Errorf("wrong instruction %d. want=%+v, got=%+v", i, want, got)
+            continue
+        }
+        for j := range want.Operands {
+            if got.Operands[j] != want.Operands[j] {
+                t.Errorf("wrong instruction %d. want=%+v, got=%+v", i, want, got)
+            }
+        }
+    }
+}
+
+func TestDecoderErrors(t *testing.T) {
+    tests := []struct {
+        ins Instructions
+        decoded int
+        expected string
+    }{
+        {concat(Make(OpPop), []byte{255}, Make(OpPop)), 1, "at 0001: opcode 255 undefined"},
+        {concat(Make(OpPop), Make(OpConst, 1)[:2]), 1, "at 0001: OpConst truncated"},
+        {concat(Make(OpConst, 1), []byte{byte(OpWide)}), 1, "at 0003: missing opcode"},
+        {concat([]byte{byte(OpWide)}, Make(OpPop)), 0, "at 0000: OpWide before OpPop"},
+    }
+
+    for _, test := range tests {
+        d := NewDecoder(test.ins)
+        n := 0
+        for d.Next() {
+            n++
+        }
+        if n != test.decoded {
+            t.Errorf("wrong number of instructions before the error in %v. want=%d, got=%d", test.ins, test.decoded, n)
+        }
+        if d.Err() == nil || d.Err().Error() != test.expected {
+            t.Errorf("wrong error for %v. want=%q, got=%v", test.ins, test.expected, d.Err())
+        }
+        // stays stopped
+        if d.Next() {
+            t.Errorf("Next after an error for %v", test.ins)
+        }
+    }
+}
+
+func TestInstsStringError(t *testing.T) {
+    ins := concat(Make(OpPop), []byte{255}, Make(OpPop))
+
+    expected := "0000 OpPop\nERROR: at 0001: opcode 255 undefined\n"
+    if ins.String() != expected {
+        t.Errorf("instructions wrongly formatted.\nwant=%q\ngot=%q", expected, ins.String())
+    }
+}
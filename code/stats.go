@@ -0,0 +1,95 @@
+package code
+
+import (
+    "monkey_interpreter/object"
+)
+
+// Stats describes what bytecode is made of, see Measure.
+// Opcodes are counted by name and constants by payload, not by their
+// encoding, so the numbers compare between compiler versions.
+type Stats struct {
+    Instructions int
+    Bytes int
+    Ops map[string]*OpStats
+    Constants map[object.ObjectType]*ConstantStats
+    // the largest operand of each kind, -1 when there is none
+    MaxOperands map[OperandKind]int
+}
+
+type OpStats struct {
+    Count int
+    // with the OpWide prefixes
+    Bytes int
+    // instructions with the OpWide prefix
+    Wide int
+}
+
+type ConstantStats struct {
+    Count int
+    // 8 per integer, the length of a string
+    Bytes int
+    Largest int
+}
+
+// Measure instructions and the constant pool they use.
+func Measure(ins Instructions, constants []object.Object) (*Stats, error) {
+    s := &Stats{
+        Ops: make(map[string]*OpStats),
+        Constants: make(map[object.ObjectType]*ConstantStats),
+        MaxOperands: make(map[OperandKind]int),
+    }
+    for _, kind := range []OperandKind{OperandNumber, OperandConstant, OperandGlobal, OperandTarget, OperandTable} {
+        s.MaxOperands[kind] = -1
+    }
+
+    insts, err := Decode(ins)
+    if err != nil {
+        return nil, err
+    }
+    for _, inst := range insts {
+        def := definitions[inst.Op]
+        op, ok := s.Ops[def.Name]
+        if !ok {
+            op = &OpStats{}
+            s.Ops[def.Name] = op
+        }
+        op.Count++
+        op.Bytes += inst.Width
+        if Opcode(ins[inst.Offset]) == OpWide {
+            op.Wide++
+        }
+
+        for i, operand := range inst.Operands {
+            kind := def.OperandKind(i)
+            if operand > s.MaxOperands[kind] {
+                s.MaxOperands[kind] = operand
+            }
+        }
+
+        s.Instructions++
+        s.Bytes += inst.Width
+    }
+
+    for _, obj := range constants {
+        c, ok := s.Constants[obj.Type()]
+        if !ok {
+            c = &ConstantStats{}
+            s.Constants[obj.Type()] = c
+        }
+
+        size := 0
+        switch obj := obj.(type) {
+        case *object.Integer:
+            size = 8
+        case *object.String:
+            size = len(obj.Value)
+        }
+        c.Count++
+        c.Bytes += size
+        if size > c.Largest {
+            c.Largest = size
+        }
+    }
+
+    return s, nil
+}
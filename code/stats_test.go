@@ -0,0 +1,73 @@
+package code
+
+import (
+    "testing"
+    "monkey_interpreter/object"
+)
+
+func TestMeasure(t *testing.T) {
+    ins := concat(
+        Make(OpConst, 0),
+        Make(OpConst, 70000),
+        Make(OpSetGlobal, 3),
+        Make(OpJump, 0),
+        Make(OpPop),
+    )
+    constants := []object.Object{
+        &object.Integer{Value: 1},
+        &object.String{Value: "monkey"},
+        &object.String{Value: ""},
+    }
+
+    s, err := Measure(ins, constants)
+    if err != nil {
+        t.Fatalf("measure error: %s", err)
+    }
+
+    if s.Instructions != 5 || s.Bytes != len(ins) {
+        t.Errorf("wrong totals. want=5 and %d bytes, got=%d and %d bytes", len(ins), s.Instructions, s.Bytes)
+    }
+
+    ops := map[string]OpStats{
+        "OpConst": {Count: 2, Bytes: 9, Wide: 1},
+        "OpSetGlobal": {Count: 1, Bytes: 3},
+        "OpJump": {Count: 1, Bytes: 3},
+        "OpPop": {Count: 1, Bytes: 1},
+    }
+    if len(s.Ops) != len(ops) {
+        t.Errorf("wrong number of opcodes. want=%d, got=%d", len(ops), len(s.Ops))
+    }
+    for name, want := range ops {
+        if got, ok := s.Ops[name]; !ok || *got != want {
+            t.Errorf("wrong stats of %s. want=%+v, got=%+v", name, want, got)
+        }
+    }
+
+    types := map[object.ObjectType]ConstantStats{
+        object.INTEGER_OBJ: {Count: 1, Bytes: 8, Largest: 8},
+        object.STRING_OBJ: {Count: 2, Bytes: 6, Largest: 6},
+    }
+    for typ, want := range types {
+        if got, ok := s.Constants[typ]; !ok || *got != want {
+            t.Errorf("wrong stats of %s constants. want=%+v, got=%+v", typ, want, got)
+        }
+    }
+
+    maxOperands := map[OperandKind]int{
+        OperandNumber: -1,
+        OperandConstant: 70000,
+        OperandGlobal: 3,
+        OperandTarget: 0,
+        OperandTable: -1,
+    }
+    for kind, want := range maxOperands {
+        if s.MaxOperands[kind] != want {
+            t.Errorf("wrong largest operand of kind %d. want=%d, got=%d", kind, want, s.MaxOperands[kind])
+        }
+    }
+
+    _, err = Measure(Instructions{255}, nil)
+    if err == nil {
+        t.Errorf("expected an error for an undefined opcode")
+    }
+}
@@ -0,0 +1,57 @@
+package compiler
+
+import (
+    "fmt"
+    "monkey_compiler/code"
+)
+
+// Assemble assembly text into Bytecode, see code.Assemble for the syntax.
+// Handlers and jump tables are declared in the order they are indexed:
+//
+//     .handler start end target depth   ; a Handler
+//     .table min default target...      ; a JumpTable, OpJumpTable's operand
+//
+// Positions may be labels.
+func Assemble(src string) (*Bytecode, error) {
+    a, err := code.Assemble(src)
+    if err != nil {
+        return nil, err
+    }
+
+    bc := &Bytecode{
+        Instructions: a.Instructions,
+        Constants: a.Constants,
+        Handlers: []Handler{},
+        JumpTables: []JumpTable{},
+    }
+
+    for _, d := range a.Directives {
+        switch d.Name {
+        case ".handler":
+            if len(d.Args) != 4 {
+                return nil, fmt.Errorf("line %d: .handler takes start, end, target and depth", d.Line)
+            }
+            bc.Handlers = append(bc.Handlers, Handler{
+                Start: d.Args[0],
+                End: d.Args[1],
+                Target: d.Args[2],
+                StackDepth: d.Args[3],
+            })
+
+        case ".table":
+            if len(d.Args) < 2 {
+                return nil, fmt.Errorf("line %d: .table takes min, default and targets", d.Line)
+            }
+            bc.JumpTables = append(bc.JumpTables, JumpTable{
+                Min: int64(d.Args[0]),
+                Default: d.Args[1],
+                Targets: d.Args[2:],
+            })
+
+        default:
+            return nil, fmt.Errorf("line %d: unknown directive %s", d.Line, d.Name)
+        }
+    }
+
+    return bc, nil
+}
@@ -15,20 +15,89 @@ type Compiler struct {
     // * operator(OpGetGlobal: 1byte) + index of operand(2byte)
     // * operator(OpArray: 1byte) + length of array(2byte)
     // * operator(otherwise: 1byte)
+    // * OpWide(1byte) + any of the above with 4byte operands
     instructions code.Instructions
 
     // constants pool
     constants []object.Object
+    // pool index of each integer and string constant, so equal ones are shared
+    constantIndex map[ConstantKey]int
 
     lastInstruction EmitedInstruction
     prevInstruction EmitedInstruction
 
     symbolTable *SymbolTable
+
+    // exception handler table, innermost handlers first
+    handlers []Handler
+
+    jumpTables []JumpTable
+
+    options Options
+
+    // unreachable code found while compiling
+    warnings []string
+
+    // position -> target of jumps whose target needs a wide operand
+    wideJumps map[int]int
+
+    // name -> index of globals left for the linker, see CompileUnit.
+    // nil when an undefined name is an error.
+    imports map[string]int
+}
+
+// Number of globals a program can have. A wide operand could address
+// more, this keeps the VM's globals store to a sane size.
+const MaxGlobals = 1 << 20
+
+// Optional compiler passes. All of them are off by default.
+type Options struct {
+    // evaluate constant integer, string and boolean expressions at compile time
+    FoldConstants bool
+    // run the peephole optimizer over the instructions returned by Bytecode
+    Peephole bool
+    // compile only the live branch of an if whose condition is a constant
+    DeadBranches bool
+    // replace hot opcode sequences with fused superinstructions
+    Superinstructions bool
 }
 
 type Bytecode struct {
     Instructions code.Instructions
     Constants []object.Object
+    Handlers []Handler
+    JumpTables []JumpTable
+    // name of each global by index, for tools. The VM doesn't need it and
+    // the .mbc format doesn't keep it, nil when unknown.
+    Globals []string
+}
+
+// Handler protects the instructions in [Start, End).
+// When a value is thrown there, the VM restores the stack to StackDepth,
+// pushes the thrown value and continues at Target.
+// A finally block is compiled inline after the try and catch blocks, and
+// a handler covering the catch block rethrows (OpThrow) after running it.
+type Handler struct {
+    Start int
+    End int
+    Target int
+    StackDepth int
+}
+
+// JumpTable is the operand of OpJumpTable.
+// An Integer v with Min <= v < Min+len(Targets) jumps to Targets[v-Min],
+// anything else jumps to Default.
+type JumpTable struct {
+    Min int64
+    Targets []int
+    Default int
+}
+
+// Equal integer or string constants have the same key, see KeyOfConstant.
+type ConstantKey struct {
+    Type object.ObjectType
+    Integer int64
+    String string
 }
 
 type EmitedInstruction struct {
@@ -40,9 +109,13 @@ func New() *Compiler {
     return &Compiler{
         instructions: code.Instructions{},
         constants: []object.Object{},
+        constantIndex: make(map[ConstantKey]int),
         lastInstruction: EmitedInstruction{},
         prevInstruction: EmitedInstruction{},
         symbolTable: NewSymbolTable(),
+        handlers: []Handler{},
+        jumpTables: []JumpTable{},
+        wideJumps: make(map[int]int),
     }
 }
 
@@ -50,9 +123,26 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
     compiler := New()
     compiler.symbolTable = s
     compiler.constants = constants
+    for i, obj := range constants {
+        key, ok := KeyOfConstant(obj)
+        if !ok {
+            continue
+        }
+        if _, exists := compiler.constantIndex[key]; !exists {
+            compiler.constantIndex[key] = i
+        }
+    }
     return compiler
 }
 
+func (c *Compiler) SetOptions(opts Options) {
+    c.options = opts
+}
+
+func (c *Compiler) Warnings() []string {
+    return c.warnings
+}
+
 func (c *Compiler) Compile(node ast.Node) error {
     switch node := node.(type) {
     case *ast.Program:
@@ -62,6 +152,7 @@ func (c *Compiler) Compile(node ast.Node) error {
                 return err
             }
         }
+        return c.checkLimits()
 
     case *ast.LetStatement:
         err := c.Compile(node.Value)
@@ -69,6 +160,9 @@ func (c *Compiler) Compile(node ast.Node) error {
             return err
         }
         symbol := c.symbolTable.Define(node.Name.Value)
+        if symbol.Index >= MaxGlobals {
+            return fmt.Errorf("too many globals: the limit is %d", MaxGlobals)
+        }
         c.emit(code.OpSetGlobal, symbol.Index)
 
     case *ast.ExpressionStatement:
@@ -94,13 +188,24 @@ func (c *Compiler) Compile(node ast.Node) error {
         c.emit(code.OpConst, c.addConstant(integer))
 
     case *ast.StringLiteral:
+        if IsTemplate(node.Value) {
+            return c.compileTemplate(node.Value)
+        }
+
         str := &object.String{Value: node.Value}
         c.emit(code.OpConst, c.addConstant(str))
 
     case *ast.Identifier:
         symbol, ok := c.symbolTable.Resolve(node.Value)
         if !ok {
-            return fmt.Errorf("undefined variable %s", node.Value)
+            if c.imports == nil {
+                return fmt.Errorf("undefined variable %s", node.Value)
+            }
+            symbol = c.symbolTable.Define(node.Value)
+            if symbol.Index >= MaxGlobals {
+                return fmt.Errorf("too many globals: the limit is %d", MaxGlobals)
+            }
+            c.imports[node.Value] = symbol.Index
         }
         c.emit(code.OpGetGlobal, symbol.Index)
 
@@ -114,6 +219,12 @@ func (c *Compiler) Compile(node ast.Node) error {
         c.emit(opc)
 
     case *ast.InfixExpression:
+        if c.options.FoldConstants {
+            if obj, ok := foldConstant(node); ok {
+                c.emitConstant(obj)
+                return nil
+            }
+        }
 
         if node.Operator == "<" {
             err := c.Compile(node.Right)
@@ -158,6 +269,13 @@ func (c *Compiler) Compile(node ast.Node) error {
         }
 
     case *ast.PrefixExpression:
+        if c.options.FoldConstants {
+            if obj, ok := foldConstant(node); ok {
+                c.emitConstant(obj)
+                return nil
+            }
+        }
+
         err := c.Compile(node.Right)
         if err != nil {
             return err
@@ -173,6 +291,12 @@ func (c *Compiler) Compile(node ast.Node) error {
         }
 
     case *ast.IfExpression:
+        if c.options.DeadBranches {
+            if cond, ok := foldConstant(node.Cond); ok {
+                return c.compileConstantIf(node, isTruthyConstant(cond))
+            }
+        }
+
         err := c.Compile(node.Cond)
         if err != nil {
             return err
@@ -180,13 +304,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 
         jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
 
-        err = c.Compile(node.Cons)
+        err = c.compileBlockValue(node.Cons)
         if err != nil {
             return err
         }
-        if c.lastInstructionIsPop() {
-            c.removeLastPop()
-        }
 
         jumpPos := c.emit(code.OpJump, 9999)
 
@@ -196,13 +317,10 @@ func (c *Compiler) Compile(node ast.Node) error {
         if node.Alt == nil {
             c.emit(code.OpNull)
         } else {
-            err = c.Compile(node.Alt)
+            err = c.compileBlockValue(node.Alt)
             if err != nil {
                 return err
             }
-            if c.lastInstructionIsPop() {
-                c.removeLastPop()
-            }
         }
 
         afterAltPos := len(c.instructions)
@@ -259,11 +377,100 @@ func (c *Compiler) Compile(node ast.Node) error {
     return nil
 }
 
+// Only the branch selected by a constant condition is compiled.
+func (c *Compiler) compileConstantIf(node *ast.IfExpression, cond bool) error {
+    live, dead := node.Cons, node.Alt
+    if !cond {
+        live, dead = node.Alt, node.Cons
+    }
+
+    if dead != nil && len(dead.Statements) > 0 {
+        c.warnings = append(c.warnings,
+            fmt.Sprintf("unreachable code in %s: %s", node.String(), dead.String()))
+    }
+
+    if live == nil {
+        c.emit(code.OpNull)
+        return nil
+    }
+
+    return c.compileBlockValue(live)
+}
+
+// A block as an expression: the value of its last expression statement is
+// left on the stack, Null when it doesn't end with one.
+func (c *Compiler) compileBlockValue(block *ast.BlockStatement) error {
+    start := len(c.instructions)
+    err := c.Compile(block)
+    if err != nil {
+        return err
+    }
+
+    if len(c.instructions) > start && c.lastInstructionIsPop() {
+        c.removeLastPop()
+    } else {
+        c.emit(code.OpNull)
+    }
+    return nil
+}
+
+func isTruthyConstant(obj object.Object) bool {
+    if b, ok := obj.(*object.Boolean); ok {
+        return b.Value
+    }
+    return true
+}
+
+// All parts are pushed and joined by a single OpConcat.
+func (c *Compiler) compileTemplate(s string) error {
+    parts, err := ParseTemplate(s)
+    if err != nil {
+        return err
+    }
+
+    for _, part := range parts {
+        if part.Expr == nil {
+            str := &object.String{Value: part.Literal}
+            c.emit(code.OpConst, c.addConstant(str))
+            continue
+        }
+
+        err := c.Compile(part.Expr)
+        if err != nil {
+            return err
+        }
+    }
+
+    c.emit(code.OpConcat, len(parts))
+    return nil
+}
+
+// Operands past MaxOperand are encoded wide, these are what even that
+// can't hold.
+func (c *Compiler) checkLimits() error {
+    if len(c.constants) - 1 > code.MaxWideOperand {
+        return fmt.Errorf("too many constants: the limit is %d", code.MaxWideOperand + 1)
+    }
+    // jump targets may be anywhere up to the end
+    if len(c.instructions) > code.MaxWideOperand {
+        return fmt.Errorf("program too large: the limit is %d bytes of instructions", code.MaxWideOperand)
+    }
+    return nil
+}
+
 func (c *Compiler) Bytecode() *Bytecode {
-    return &Bytecode {
+    bc := &Bytecode {
         Instructions: c.instructions,
         Constants: c.constants,
+        Handlers: c.handlers,
+        JumpTables: c.jumpTables,
+        Globals: c.symbolTable.Names(),
     }
+
+    if c.options.Peephole || c.options.Superinstructions || len(c.wideJumps) > 0 {
+        return optimize(bc, c.options.Peephole, c.options.Superinstructions, c.wideJumps)
+    }
+    return bc
 }
 
 // Generate an instruction and add it to the result.
@@ -277,6 +484,20 @@ func (c *Compiler) emit(op code.Opcode, operands ...int) int {
     return pos
 }
 
+// Push a folded value, booleans use OpTrue/OpFalse instead of the pool.
+func (c *Compiler) emitConstant(obj object.Object) {
+    if b, ok := obj.(*object.Boolean); ok {
+        if b.Value {
+            c.emit(code.OpTrue)
+        } else {
+            c.emit(code.OpFalse)
+        }
+        return
+    }
+
+    c.emit(code.OpConst, c.addConstant(obj))
+}
+
 func (c *Compiler) setLastInstruction(op code.Opcode, pos int) {
     last := EmitedInstruction{Opcode: op, Position: pos}
     c.prevInstruction = c.lastInstruction
@@ -289,9 +510,33 @@ func (c *Compiler) addInstruction(ins []byte) int {
     return posNewInstruction
 }
 
+// Integers and strings are interned: an equal constant already in the pool
+// is reused instead of appending a new one.
 func (c *Compiler) addConstant(obj object.Object) int {
+    key, ok := KeyOfConstant(obj)
+    if ok {
+        if i, exists := c.constantIndex[key]; exists {
+            return i
+        }
+    }
+
     c.constants = append(c.constants, obj)
-    return len(c.constants) - 1
+    index := len(c.constants) - 1
+    if ok {
+        c.constantIndex[key] = index
+    }
+    return index
+}
+
+// The key a constant is interned under, false for one that isn't.
+func KeyOfConstant(obj object.Object) (ConstantKey, bool) {
+    switch obj := obj.(type) {
+    case *object.Integer:
+        return ConstantKey{Type: obj.Type(), Integer: obj.Value}, true
+    case *object.String:
+        return ConstantKey{Type: obj.Type(), String: obj.Value}, true
+    }
+    return ConstantKey{}, false
 }
 
 func (c *Compiler) lastInstructionIsPop() bool {
@@ -309,8 +554,14 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
     }
 }
 
+// A jump target too large for the operand would change the length of the
+// instruction. It is kept aside for Bytecode, which reassembles the code.
 func (c *Compiler) changeOperand(opPos int, operand int) {
     op := code.Opcode(c.instructions[opPos])
+    if operand > code.MaxOperand {
+        c.wideJumps[opPos] = operand
+        return
+    }
     newInstruction := code.Make(op, operand)
     c.replaceInstruction(opPos, newInstruction)
 }
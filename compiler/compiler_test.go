@@ -3,6 +3,7 @@ package compiler
 import (
     "testing"
     "fmt"
+    "strings"
     "monkey_interpreter/ast"
     "monkey_interpreter/lexer"
     "monkey_interpreter/parser"
@@ -293,6 +294,55 @@ func TestStringExpressions(t *testing.T) {
     runCompilerTest(t, tests)
 }
 
+func TestTemplateStrings(t *testing.T) {
+    tests := []compilerTestCase {
+        {
+            input: `let n = 3; "you have ${n} items"`,
+            expectedConstants: []interface{}{3, "you have ", " items"},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpGetGlobal, 0),
+                code.Make(code.OpConst, 2),
+                code.Make(code.OpConcat, 3),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: `"${1 + 2}"`,
+            expectedConstants: []interface{}{1, 2},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpAdd),
+                code.Make(code.OpConcat, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: `let n = 3; "\${n} is ${n}, \${"`,
+            expectedConstants: []interface{}{3, "${n} is ", ", ${"},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpGetGlobal, 0),
+                code.Make(code.OpConst, 2),
+                code.Make(code.OpConcat, 3),
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    runCompilerTest(t, tests)
+
+    _, err := ParseTemplate("a ${1 + ")
+    if err == nil {
+        t.Errorf("expected error for unterminated ${")
+    }
+}
+
 func TestArrayLiterals(t *testing.T) {
     tests := []compilerTestCase {
         {
@@ -385,14 +435,14 @@ func TestIndexExpressions(t *testing.T) {
     tests := []compilerTestCase {
         {
             input: "[1, 2, 3][1 + 1]",
-            expectedConstants: []interface{}{1, 2, 3, 1, 1},
+            expectedConstants: []interface{}{1, 2, 3},
             expectedInstructions: []code.Instructions {
                 code.Make(code.OpConst, 0),
                 code.Make(code.OpConst, 1),
                 code.Make(code.OpConst, 2),
                 code.Make(code.OpArray, 3),
-                code.Make(code.OpConst, 3),
-                code.Make(code.OpConst, 4),
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpConst, 0),
                 code.Make(code.OpAdd),
                 code.Make(code.OpIndex),
                 code.Make(code.OpPop),
@@ -400,13 +450,13 @@ func TestIndexExpressions(t *testing.T) {
         },
         {
             input: "{1: 2}[2 - 1]",
-            expectedConstants: []interface{}{1, 2, 2, 1},
+            expectedConstants: []interface{}{1, 2},
             expectedInstructions: []code.Instructions {
                 code.Make(code.OpConst, 0),
                 code.Make(code.OpConst, 1),
                 code.Make(code.OpHash, 2),
-                code.Make(code.OpConst, 2),
-                code.Make(code.OpConst, 3),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpConst, 0),
                 code.Make(code.OpSub),
                 code.Make(code.OpIndex),
                 code.Make(code.OpPop),
@@ -417,14 +467,342 @@ func TestIndexExpressions(t *testing.T) {
     runCompilerTest(t, tests)
 }
 
+func TestConstantFolding(t *testing.T) {
+    tests := []compilerTestCase {
+        {
+            input: "1 + 2 * 3",
+            expectedConstants: []interface{}{7},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "-(10 / 3) < 2",
+            expectedConstants: []interface{}{},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpTrue),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: `"mon" + "key"`,
+            expectedConstants: []interface{}{"monkey"},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "!(true == false)",
+            expectedConstants: []interface{}{},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpTrue),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "let x = 1; x + 2 * 3",
+            expectedConstants: []interface{}{1, 6},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpGetGlobal, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpAdd),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "(1 + 1) / 0",
+            expectedConstants: []interface{}{2, 0},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpDiv),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: `"a" + "b" == "ab"`,
+            expectedConstants: []interface{}{},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpTrue),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: `"a" < "b"`,
+            expectedConstants: []interface{}{"b", "a"},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpGT),
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    runCompilerTestWithOptions(t, Options{FoldConstants: true}, tests)
+}
+
+func TestDeadBranchElimination(t *testing.T) {
+    tests := []compilerTestCase {
+        {
+            input: "if (true) { 10 } else { 20 }; 3333;",
+            expectedConstants: []interface{}{10, 3333},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpPop),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "if (1 > 2) { 10 }",
+            expectedConstants: []interface{}{},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpNull),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "let x = true; if (x) { 10 } else { 20 }",
+            expectedConstants: []interface{}{10, 20},
+            expectedInstructions: []code.Instructions{
+                // 0000
+                code.Make(code.OpTrue),
+                // 0001
+                code.Make(code.OpSetGlobal, 0),
+                // 0004
+                code.Make(code.OpGetGlobal, 0),
+                // 0007
+                code.Make(code.OpJumpNotTruthy, 16),
+                // 0010
+                code.Make(code.OpConst, 0),
+                // 0013
+                code.Make(code.OpJump, 19),
+                // 0016
+                code.Make(code.OpConst, 1),
+                // 0019
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    runCompilerTestWithOptions(t, Options{DeadBranches: true}, tests)
+
+    compiler := New()
+    compiler.SetOptions(Options{DeadBranches: true})
+    err := compiler.Compile(parse("if (false) { 10 } else { 20 }; if (true) { 30 };"))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    if len(compiler.Warnings()) != 1 {
+        t.Errorf("wrong number of warnings. want=1, got=%q", compiler.Warnings())
+    }
+}
+
+func TestConstantPoolDeduplication(t *testing.T) {
+    tests := []compilerTestCase {
+        {
+            input: `let a = 1; let b = 1; "id" + "id" + a`,
+            expectedConstants: []interface{}{1, "id"},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 1),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpAdd),
+                code.Make(code.OpGetGlobal, 0),
+                code.Make(code.OpAdd),
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    runCompilerTest(t, tests)
+
+    // repeated REPL lines share the pool through NewWithState
+    symbolTable := NewSymbolTable()
+    constants := []object.Object{}
+    for i := 0; i < 10; i++ {
+        compiler := NewWithState(symbolTable, constants)
+        err := compiler.Compile(parse(`[1, "id", 1, "id"]`))
+        if err != nil {
+            t.Fatalf("compiler error: %s", err)
+        }
+        constants = compiler.Bytecode().Constants
+    }
+
+    if len(constants) != 2 {
+        t.Errorf("constant pool grew. want=2, got=%d", len(constants))
+    }
+}
+
+func TestWideJumps(t *testing.T) {
+    // a consequence longer than 65535 bytes
+    var src strings.Builder
+    src.WriteString("if (true) { 0")
+    for i := 1; i <= 20000; i++ {
+        fmt.Fprintf(&src, " + %d", i)
+    }
+    src.WriteString(" }; 1")
+
+    comp := New()
+    err := comp.Compile(parse(src.String()))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    ins := comp.Bytecode().Instructions
+
+    // true, OpJumpNotTruthy, the consequence, OpJump, OpNull, OpPop, 1, OpPop
+    op, operands, width, err := code.ReadInstruction(ins[1:])
+    if err != nil {
+        t.Fatalf("decode error: %s", err)
+    }
+    if op != code.OpJumpNotTruthy || width != 6 {
+        t.Fatalf("expected a wide OpJumpNotTruthy. got=%d (%d bytes)", op, width)
+    }
+    // after OpJump and before OpNull
+    if target := code.Opcode(ins[operands[0]]); target != code.OpNull {
+        t.Errorf("OpJumpNotTruthy lands on %d, not on OpNull", target)
+    }
+}
+
+func TestWideGlobals(t *testing.T) {
+    var src strings.Builder
+    for i := 0; i < 70000; i++ {
+        fmt.Fprintf(&src, "let g%d = 0;", i)
+    }
+    src.WriteString("g69999")
+
+    comp := New()
+    err := comp.Compile(parse(src.String()))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+
+    insts, err := code.Decode(comp.Bytecode().Instructions)
+    if err != nil {
+        t.Fatalf("decode error: %s", err)
+    }
+    // g69999; OpPop
+    get := insts[len(insts) - 2]
+    if get.Op != code.OpGetGlobal || get.Operands[0] != 69999 || get.Width != 6 {
+        t.Errorf("expected a wide OpGetGlobal 69999. got=%d %v (%d bytes)", get.Op, get.Operands, get.Width)
+    }
+}
+
+// Following the stack effects in the opcode definitions, every compiled
+// program agrees with itself on the stack depth and leaves nothing behind.
+func TestStackEffects(t *testing.T) {
+    inputs := []string{
+        "1 + 2 * 3; -4",
+        "let x = 1; if (x > 2) { 10 } else { [x, x, {1: 2}[x]] }",
+        "if (true) { } ; !false",
+        `let n = 2; "${n} + ${n} = ${n + n}"`,
+        `let a = [1, 2]; a[0] == 1; a[1] != 2`,
+    }
+
+    for _, input := range inputs {
+        for _, opts := range []Options{{}, {FoldConstants: true, Peephole: true, DeadBranches: true, Superinstructions: true}} {
+            comp := New()
+            comp.SetOptions(opts)
+            err := comp.Compile(parse(input))
+            if err != nil {
+                t.Fatalf("compiler error: %s", err)
+            }
+
+            bc := comp.Bytecode()
+            depths, err := stackDepths(bc)
+            if err != nil {
+                t.Errorf("%q: %s\n%s", input, err, bc.Instructions)
+                continue
+            }
+            if depths[len(bc.Instructions)] != 0 {
+                t.Errorf("%q: %d values left on the stack", input, depths[len(bc.Instructions)])
+            }
+        }
+    }
+}
+
+// The stack depth before each reachable instruction, and at the end.
+func stackDepths(bc *Bytecode) (map[int]int, error) {
+    depths := map[int]int{0: 0}
+    work := []int{0}
+
+    reach := func(pos, depth int) error {
+        if d, ok := depths[pos]; ok {
+            if d != depth {
+                return fmt.Errorf("%04d reached with depths %d and %d", pos, d, depth)
+            }
+            return nil
+        }
+        depths[pos] = depth
+        work = append(work, pos)
+        return nil
+    }
+
+    for len(work) > 0 {
+        pos := work[len(work) - 1]
+        work = work[:len(work) - 1]
+        if pos == len(bc.Instructions) {
+            continue
+        }
+
+        op, operands, width, err := code.ReadInstruction(bc.Instructions[pos:])
+        if err != nil {
+            return nil, err
+        }
+        def, _ := code.Lookup(byte(op))
+
+        depth := depths[pos]
+        pops, pushes := def.StackEffect(operands)
+        if pops > depth {
+            return nil, fmt.Errorf("%04d %s pops %d of %d", pos, def.Name, pops, depth)
+        }
+
+        targets := []int{}
+        if def.Flags&code.Jump != 0 {
+            targets = append(targets, operands[0])
+        }
+        if op == code.OpJumpTable {
+            table := bc.JumpTables[operands[0]]
+            targets = append(append(targets, table.Targets...), table.Default)
+        }
+        for _, target := range targets {
+            if err := reach(target, depth - def.BranchPops); err != nil {
+                return nil, err
+            }
+        }
+        if def.Flags&code.NoFallthrough == 0 {
+            if err := reach(pos + width, depth - pops + pushes); err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    return depths, nil
+}
+
 func runCompilerTest(t *testing.T, tests []compilerTestCase) {
     t.Helper()
 
+    runCompilerTestWithOptions(t, Options{}, tests)
+}
+
+func runCompilerTestWithOptions(t *testing.T, opts Options, tests []compilerTestCase) {
+    t.Helper()
+
     for _, test := range tests {
 
         program := parse(test.input)
 
         compiler := New()
+        compiler.SetOptions(opts)
         err := compiler.Compile(program)
 
         if err != nil {
@@ -0,0 +1,148 @@
+package compiler
+
+import (
+    "bytes"
+    "fmt"
+    "sort"
+    "strconv"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+// Disassemble bc in the syntax of Assemble, so the output reads back.
+// Jump targets, handler boundaries and jump table entries get labels, and
+// constant operands show their value in a comment.
+// There are no compiled functions to recurse into and no line table to
+// annotate yet.
+func Disassemble(bc *Bytecode) string {
+    var out bytes.Buffer
+
+    if len(bc.Constants) > 0 {
+        out.WriteString(".constants\n")
+        for i, c := range bc.Constants {
+            fmt.Fprintf(&out, "    %d %s\n", i, formatConstant(c))
+        }
+        out.WriteString(".code\n")
+    }
+
+    labels := labelPositions(bc)
+
+    for _, h := range bc.Handlers {
+        fmt.Fprintf(&out, ".handler %s %s %s %d\n",
+            labels[h.Start], labels[h.End], labels[h.Target], h.StackDepth)
+    }
+    for _, table := range bc.JumpTables {
+        fmt.Fprintf(&out, ".table %d %s", table.Min, labels[table.Default])
+        for _, t := range table.Targets {
+            fmt.Fprintf(&out, " %s", labels[t])
+        }
+        out.WriteString("\n")
+    }
+
+    ins := bc.Instructions
+    printed := map[int]bool{}
+    d := code.NewDecoder(ins)
+    for d.Next() {
+        inst := d.Instruction()
+        if label, ok := labels[inst.Offset]; ok {
+            fmt.Fprintf(&out, "%s:\n", label)
+            printed[inst.Offset] = true
+        }
+        def, _ := code.Lookup(byte(inst.Op))
+
+        fields := def.Name
+        for j, operand := range inst.Operands {
+            if j == 0 && def.Flags&code.Jump != 0 {
+                fields += " " + labels[operand]
+            } else {
+                fields += fmt.Sprintf(" %d", operand)
+            }
+        }
+
+        comment := ""
+        for j, operand := range inst.Operands {
+            if def.OperandKind(j) == code.OperandConstant && operand < len(bc.Constants) {
+                comment = formatConstant(bc.Constants[operand])
+            }
+        }
+        if inst.Op == code.OpJumpTable {
+            comment = fmt.Sprintf("table %d", inst.Operands[0])
+        }
+
+        if comment == "" {
+            fmt.Fprintf(&out, "%04d    %s\n", inst.Offset, fields)
+        } else {
+            fmt.Fprintf(&out, "%04d    %-24s ; %s\n", inst.Offset, fields, comment)
+        }
+    }
+    if err := d.Err(); err != nil {
+        // the rest can't be decoded
+        fmt.Fprintf(&out, "; ERROR: %s\n", err)
+        return out.String()
+    }
+
+    if label, ok := labels[len(ins)]; ok {
+        fmt.Fprintf(&out, "%s:\n", label)
+        printed[len(ins)] = true
+    }
+
+    // 命令の途中や範囲外を指すラベルは書きようがないので、せめて見せる
+    positions := []int{}
+    for pos := range labels {
+        if !printed[pos] {
+            positions = append(positions, pos)
+        }
+    }
+    sort.Ints(positions)
+    for _, pos := range positions {
+        fmt.Fprintf(&out, "; %s = %04d is not an instruction boundary\n", labels[pos], pos)
+    }
+
+    return out.String()
+}
+
+// L0, L1, ... for every position something refers to, in order.
+func labelPositions(bc *Bytecode) map[int]string {
+    positions := map[int]bool{}
+
+    // as far as the instructions decode
+    insts, _ := code.Decode(bc.Instructions)
+    for _, inst := range insts {
+        if code.Has(inst.Op, code.Jump) {
+            positions[inst.Operands[0]] = true
+        }
+    }
+    for _, h := range bc.Handlers {
+        positions[h.Start] = true
+        positions[h.End] = true
+        positions[h.Target] = true
+    }
+    for _, table := range bc.JumpTables {
+        positions[table.Default] = true
+        for _, t := range table.Targets {
+            positions[t] = true
+        }
+    }
+
+    sorted := []int{}
+    for pos := range positions {
+        sorted = append(sorted, pos)
+    }
+    sort.Ints(sorted)
+
+    labels := map[int]string{}
+    for i, pos := range sorted {
+        labels[pos] = fmt.Sprintf("L%d", i)
+    }
+    return labels
+}
+
+func formatConstant(obj object.Object) string {
+    switch obj := obj.(type) {
+    case *object.String:
+        return strconv.Quote(obj.Value)
+    case *object.Integer:
+        return fmt.Sprintf("%d", obj.Value)
+    }
+    return obj.Inspect()
+}
@@ -0,0 +1,114 @@
+package compiler
+
+import (
+    "testing"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+func TestDisassemble(t *testing.T) {
+    comp := New()
+    err := comp.Compile(parse(`let s = "a;b"; if (s == "x") { 42 } else { s }`))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+
+    expected := `.constants
+    0 "a;b"
+    1 "x"
+    2 42
+.code
+0000    OpConst 0                ; "a;b"
+0003    OpSetGlobal 0
+0006    OpGetGlobal 0
+0009    OpConst 1                ; "x"
+0012    OpEq
+0013    OpJumpNotTruthy L0
+0016    OpConst 2                ; 42
+0019    OpJump L1
+L0:
+0022    OpGetGlobal 0
+L1:
+0025    OpPop
+`
+    got := Disassemble(comp.Bytecode())
+    if got != expected {
+        t.Errorf("wrong disassembly.\nwant=%s\ngot=%s", expected, got)
+    }
+}
+
+func TestDisassembleTables(t *testing.T) {
+    bc := &Bytecode{
+        Instructions: concatInstructions([]code.Instructions{
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpJumpTable, 0),
+            code.Make(code.OpThrow),
+            code.Make(code.OpGetGlobalConstAdd, 1, 0),
+        }),
+        Constants: []object.Object{&object.Integer{Value: -7}},
+        Handlers: []Handler{{Start: 0, End: 6, Target: 7, StackDepth: 0}},
+        JumpTables: []JumpTable{{Min: 1, Targets: []int{6, 7, 12}, Default: 12}},
+    }
+
+    expected := `.constants
+    0 -7
+.code
+.handler L0 L1 L2 0
+.table 1 L3 L1 L2 L3
+L0:
+0000    OpConst 0                ; -7
+0003    OpJumpTable 0            ; table 0
+L1:
+0006    OpThrow
+L2:
+0007    OpGetGlobalConstAdd 1 0  ; -7
+L3:
+`
+    got := Disassemble(bc)
+    if got != expected {
+        t.Errorf("wrong disassembly.\nwant=%s\ngot=%s", expected, got)
+    }
+}
+
+// Disassembly is valid assembly for the same bytecode.
+func TestDisassembleRoundTrip(t *testing.T) {
+    inputs := []string {
+        "1 + 2",
+        `let s = "a; b"; [s, "", -1]`,
+        `let n = 2; "${n} + ${n} = ${n + n}"`,
+        "let x = 1; if (x > 2) { 10 } else { {1: 2}[x] }",
+        "if (true) { } else { 1 }",
+    }
+
+    bytecodes := []*Bytecode{}
+    for _, input := range inputs {
+        for _, opts := range []Options{{}, {FoldConstants: true, Peephole: true, Superinstructions: true}} {
+            comp := New()
+            comp.SetOptions(opts)
+            err := comp.Compile(parse(input))
+            if err != nil {
+                t.Fatalf("compiler error: %s", err)
+            }
+            bytecodes = append(bytecodes, comp.Bytecode())
+        }
+    }
+    bytecodes = append(bytecodes, &Bytecode{
+        Instructions: concatInstructions([]code.Instructions{
+            code.Make(code.OpConst, 70000),
+            code.Make(code.OpJumpTable, 0),
+            code.Make(code.OpThrow),
+        }),
+        Constants: []object.Object{},
+        Handlers: []Handler{{Start: 0, End: 9, Target: 10, StackDepth: 1}},
+        JumpTables: []JumpTable{{Min: -3, Targets: []int{6, 9}, Default: 0}},
+    })
+
+    for _, bc := range bytecodes {
+        text := Disassemble(bc)
+        assembled, err := Assemble(text)
+        if err != nil {
+            t.Fatalf("assemble error: %s\n%s", err, text)
+        }
+        testSameBytecode(t, bc, assembled)
+    }
+}
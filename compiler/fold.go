@@ -0,0 +1,131 @@
+package compiler
+
+import (
+    "monkey_interpreter/ast"
+    "monkey_interpreter/object"
+)
+
+// Evaluate an expression at compile time.
+// Only pure integer, string and boolean operations whose result is the same
+// as the VM's are folded; anything that may fail at runtime is left alone.
+func foldConstant(node ast.Expression) (object.Object, bool) {
+    switch node := node.(type) {
+    case *ast.IntegerLiteral:
+        return &object.Integer{Value: node.Value}, true
+
+    case *ast.StringLiteral:
+        if IsTemplate(node.Value) {
+            return nil, false
+        }
+        return &object.String{Value: node.Value}, true
+
+    case *ast.Boolean:
+        return &object.Boolean{Value: node.Value}, true
+
+    case *ast.PrefixExpression:
+        right, ok := foldConstant(node.Right)
+        if !ok {
+            return nil, false
+        }
+        return foldPrefix(node.Operator, right)
+
+    case *ast.InfixExpression:
+        left, ok := foldConstant(node.Left)
+        if !ok {
+            return nil, false
+        }
+        right, ok := foldConstant(node.Right)
+        if !ok {
+            return nil, false
+        }
+        return foldInfix(node.Operator, left, right)
+    }
+
+    return nil, false
+}
+
+func foldPrefix(operator string, right object.Object) (object.Object, bool) {
+    switch operator {
+    case "!":
+        if b, ok := right.(*object.Boolean); ok {
+            return &object.Boolean{Value: !b.Value}, true
+        }
+        // integers and strings are truthy
+        return &object.Boolean{Value: false}, true
+
+    case "-":
+        if i, ok := right.(*object.Integer); ok {
+            return &object.Integer{Value: -i.Value}, true
+        }
+    }
+
+    return nil, false
+}
+
+func foldInfix(operator string, left, right object.Object) (object.Object, bool) {
+    switch left := left.(type) {
+    case *object.Integer:
+        r, ok := right.(*object.Integer)
+        if !ok {
+            return nil, false
+        }
+        return foldIntegerInfix(operator, left.Value, r.Value)
+
+    case *object.String:
+        r, ok := right.(*object.String)
+        if !ok {
+            return nil, false
+        }
+
+        switch operator {
+        case "+":
+            return &object.String{Value: left.Value + r.Value}, true
+        case "==":
+            return &object.Boolean{Value: left.Value == r.Value}, true
+        case "!=":
+            return &object.Boolean{Value: left.Value != r.Value}, true
+        }
+
+    case *object.Boolean:
+        r, ok := right.(*object.Boolean)
+        if !ok {
+            return nil, false
+        }
+
+        switch operator {
+        case "==":
+            return &object.Boolean{Value: left.Value == r.Value}, true
+        case "!=":
+            return &object.Boolean{Value: left.Value != r.Value}, true
+        }
+    }
+
+    return nil, false
+}
+
+func foldIntegerInfix(operator string, l, r int64) (object.Object, bool) {
+    switch operator {
+    case "+":
+        return &object.Integer{Value: l + r}, true
+    case "-":
+        return &object.Integer{Value: l - r}, true
+    case "*":
+        return &object.Integer{Value: l * r}, true
+    case "/":
+        // division by zero stays a runtime error
+        if r == 0 {
+            return nil, false
+        }
+        return &object.Integer{Value: l / r}, true
+    case "<":
+        return &object.Boolean{Value: l < r}, true
+    case ">":
+        return &object.Boolean{Value: l > r}, true
+    case "==":
+        return &object.Boolean{Value: l == r}, true
+    case "!=":
+        return &object.Boolean{Value: l != r}, true
+    }
+
+    return nil, false
+}
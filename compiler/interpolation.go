@@ -0,0 +1,96 @@
+package compiler
+
+import (
+    "fmt"
+    "strings"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/lexer"
+    "monkey_interpreter/parser"
+)
+
+// TemplatePart is a piece of a template string "Hello ${name}".
+// Either Literal or Expr is set.
+type TemplatePart struct {
+    Literal string
+    Expr ast.Expression
+}
+
+// Whether s is a template string: it has a ${, possibly escaped as \${.
+func IsTemplate(s string) bool {
+    return strings.Contains(s, "${")
+}
+
+// ParseTemplate splits a template string into literal text and embedded
+// expressions. \${ is a literal ${.
+func ParseTemplate(s string) ([]TemplatePart, error) {
+    parts := []TemplatePart{}
+    literal := ""
+
+    for {
+        start := strings.Index(s, "${")
+        if start < 0 {
+            break
+        }
+        if start > 0 && s[start-1] == '\\' {
+            literal += s[:start-1] + "${"
+            s = s[start+2:]
+            continue
+        }
+        literal += s[:start]
+        if len(literal) > 0 {
+            parts = append(parts, TemplatePart{Literal: literal})
+            literal = ""
+        }
+
+        // find the matching '}', the expression may contain hash literals
+        depth := 0
+        end := -1
+        for i := start + 2; i < len(s); i++ {
+            if s[i] == '{' {
+                depth++
+            } else if s[i] == '}' {
+                if depth == 0 {
+                    end = i
+                    break
+                }
+                depth--
+            }
+        }
+        if end < 0 {
+            return nil, fmt.Errorf("unterminated ${ in string %q", s)
+        }
+
+        expr, err := parseTemplateExpression(s[start+2 : end])
+        if err != nil {
+            return nil, err
+        }
+        parts = append(parts, TemplatePart{Expr: expr})
+
+        s = s[end+1:]
+    }
+
+    literal += s
+    if len(literal) > 0 {
+        parts = append(parts, TemplatePart{Literal: literal})
+    }
+
+    return parts, nil
+}
+
+func parseTemplateExpression(src string) (ast.Expression, error) {
+    p := parser.New(lexer.New(src))
+    program := p.ParseProgram()
+    if len(p.Errors()) != 0 {
+        return nil, fmt.Errorf("invalid expression ${%s}: %s", src, strings.Join(p.Errors(), ", "))
+    }
+
+    if len(program.Statements) != 1 {
+        return nil, fmt.Errorf("invalid expression ${%s}", src)
+    }
+    stmt, ok := program.Statements[0].(*ast.ExpressionStatement)
+    if !ok {
+        return nil, fmt.Errorf("invalid expression ${%s}", src)
+    }
+
+    return stmt.Expression, nil
+}
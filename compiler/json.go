@@ -0,0 +1,146 @@
+package compiler
+
+import (
+    "encoding/json"
+    "fmt"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+// The JSON form of Bytecode, for tools that want it structured. The schema
+// is docs/bytecode.schema.json:
+//
+//     {
+//       "schemaVersion": 1,
+//       "instructions": [
+//         {"offset": 0, "op": "OpConst", "operands": [0], "width": 3},
+//         {"offset": 3, "op": "OpSetGlobal", "operands": [0], "width": 3}
+//       ],
+//       "constants": [
+//         {"index": 0, "type": "INTEGER", "value": 42},
+//         {"index": 1, "type": "STRING", "value": "hello"}
+//       ],
+//       "handlers": [{"start": 3, "end": 9, "target": 12, "stackDepth": 0}],
+//       "jumpTables": [{"min": 1, "targets": [10, 14], "default": 18}],
+//       "lines": [],
+//       "globals": ["x", "", "y"]
+//     }
+//
+// instructions  every instruction in order. offset and width are in bytes,
+//               width includes an OpWide prefix. op is the name from the
+//               opcode table, the numbers may change between versions.
+//               operands are as encoded: jump operands are offsets, the
+//               operand of OpConst is a constant index.
+// constants     the pool in order. type is the object type, value a JSON
+//               number for INTEGER (an int64, may not fit a double) and a
+//               string for STRING.
+// handlers      Bytecode.Handlers, positions are offsets.
+// jumpTables    Bytecode.JumpTables, indexed by OpJumpTable's operand.
+// lines         {"offset", "line"} pairs, source line by offset. Always
+//               empty, the parser doesn't record source positions.
+// globals       names by global index, "" for one whose name was defined
+//               again. Left out when unknown, as for a loaded .mbc file.
+//
+// Lists are [] rather than null when empty. schemaVersion goes up when a
+// field changes meaning or goes away, not when one is added.
+
+const JSONSchemaVersion = 1
+
+type jsonBytecode struct {
+    SchemaVersion int `json:"schemaVersion"`
+    Instructions []jsonInstruction `json:"instructions"`
+    Constants []jsonConstant `json:"constants"`
+    Handlers []jsonHandler `json:"handlers"`
+    JumpTables []jsonJumpTable `json:"jumpTables"`
+    Lines []jsonLine `json:"lines"`
+    Globals []string `json:"globals,omitempty"`
+}
+
+type jsonInstruction struct {
+    Offset int `json:"offset"`
+    Op string `json:"op"`
+    Operands []int `json:"operands"`
+    Width int `json:"width"`
+}
+
+type jsonConstant struct {
+    Index int `json:"index"`
+    Type object.ObjectType `json:"type"`
+    Value interface{} `json:"value"`
+}
+
+type jsonHandler struct {
+    Start int `json:"start"`
+    End int `json:"end"`
+    Target int `json:"target"`
+    StackDepth int `json:"stackDepth"`
+}
+
+type jsonJumpTable struct {
+    Min int64 `json:"min"`
+    Targets []int `json:"targets"`
+    Default int `json:"default"`
+}
+
+type jsonLine struct {
+    Offset int `json:"offset"`
+    Line int `json:"line"`
+}
+
+func (bc *Bytecode) MarshalJSON() ([]byte, error) {
+    out := jsonBytecode{
+        SchemaVersion: JSONSchemaVersion,
+        Instructions: []jsonInstruction{},
+        Constants: []jsonConstant{},
+        Handlers: []jsonHandler{},
+        JumpTables: []jsonJumpTable{},
+        Lines: []jsonLine{},
+        Globals: bc.Globals,
+    }
+
+    insts, err := code.Decode(bc.Instructions)
+    if err != nil {
+        return nil, err
+    }
+    for _, inst := range insts {
+        def, _ := code.Lookup(byte(inst.Op))
+        out.Instructions = append(out.Instructions, jsonInstruction{
+            Offset: inst.Offset,
+            Op: def.Name,
+            Operands: inst.Operands,
+            Width: inst.Width,
+        })
+    }
+
+    for i, c := range bc.Constants {
+        var value interface{}
+        switch c := c.(type) {
+        case *object.Integer:
+            value = c.Value
+        case *object.String:
+            value = c.Value
+        default:
+            return nil, fmt.Errorf("cannot export constant of type %s", c.Type())
+        }
+        out.Constants = append(out.Constants, jsonConstant{Index: i, Type: c.Type(), Value: value})
+    }
+
+    for _, h := range bc.Handlers {
+        out.Handlers = append(out.Handlers, jsonHandler{
+            Start: h.Start,
+            End: h.End,
+            Target: h.Target,
+            StackDepth: h.StackDepth,
+        })
+    }
+
+    for _, table := range bc.JumpTables {
+        targets := table.Targets
+        if targets == nil {
+            targets = []int{}
+        }
+        out.JumpTables = append(out.JumpTables, jsonJumpTable{Min: table.Min, Targets: targets, Default: table.Default})
+    }
+
+    return json.Marshal(out)
+}
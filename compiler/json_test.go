@@ -0,0 +1,233 @@
+package compiler
+
+import (
+    "encoding/json"
+    "fmt"
+    "io/ioutil"
+    "strings"
+    "testing"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+func TestBytecodeJSON(t *testing.T) {
+    comp := New()
+    err := comp.Compile(parse(`let x = 1; let s = "a"; let x = 70000; x`))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+
+    data, err := json.Marshal(comp.Bytecode())
+    if err != nil {
+        t.Fatalf("marshal error: %s", err)
+    }
+
+    expected := `{"schemaVersion":1,` +
+        `"instructions":[` +
+        `{"offset":0,"op":"OpConst","operands":[0],"width":3},` +
+        `{"offset":3,"op":"OpSetGlobal","operands":[0],"width":3},` +
+        `{"offset":6,"op":"OpConst","operands":[1],"width":3},` +
+        `{"offset":9,"op":"OpSetGlobal","operands":[1],"width":3},` +
+        `{"offset":12,"op":"OpConst","operands":[2],"width":3},` +
+        `{"offset":15,"op":"OpSetGlobal","operands":[2],"width":3},` +
+        `{"offset":18,"op":"OpGetGlobal","operands":[2],"width":3},` +
+        `{"offset":21,"op":"OpPop","operands":[],"width":1}],` +
+        `"constants":[` +
+        `{"index":0,"type":"INTEGER","value":1},` +
+        `{"index":1,"type":"STRING","value":"a"},` +
+        `{"index":2,"type":"INTEGER","value":70000}],` +
+        `"handlers":[],"jumpTables":[],"lines":[],` +
+        `"globals":["","s","x"]}`
+    if string(data) != expected {
+        t.Errorf("wrong JSON.\nwant=%s\ngot=%s", expected, data)
+    }
+}
+
+func TestBytecodeJSONTables(t *testing.T) {
+    bc := &Bytecode{
+        Instructions: concatInstructions([]code.Instructions{
+            code.Make(code.OpJumpTable, 0),
+            code.Make(code.OpConst, 70000),
+        }),
+        Constants: []object.Object{},
+        Handlers: []Handler{{Start: 0, End: 3, Target: 3, StackDepth: 1}},
+        JumpTables: []JumpTable{{Min: -1, Targets: []int{3}, Default: 9}},
+    }
+
+    data, err := json.Marshal(bc)
+    if err != nil {
+        t.Fatalf("marshal error: %s", err)
+    }
+
+    expected := `{"schemaVersion":1,` +
+        `"instructions":[` +
+        `{"offset":0,"op":"OpJumpTable","operands":[0],"width":3},` +
+        `{"offset":3,"op":"OpConst","operands":[70000],"width":6}],` +
+        `"constants":[],` +
+        `"handlers":[{"start":0,"end":3,"target":3,"stackDepth":1}],` +
+        `"jumpTables":[{"min":-1,"targets":[3],"default":9}],` +
+        `"lines":[]}`
+    if string(data) != expected {
+        t.Errorf("wrong JSON.\nwant=%s\ngot=%s", expected, data)
+    }
+
+    bc.Instructions = append(bc.Instructions, 255)
+    _, err = json.Marshal(bc)
+    if err == nil {
+        t.Errorf("expected an error for an undefined opcode")
+    }
+}
+
+// MarshalJSON output follows the checked-in schema.
+func TestBytecodeJSONSchema(t *testing.T) {
+    data, err := ioutil.ReadFile("../docs/bytecode.schema.json")
+    if err != nil {
+        t.Fatalf("read schema: %s", err)
+    }
+    var schema map[string]interface{}
+    err = json.Unmarshal(data, &schema)
+    if err != nil {
+        t.Fatalf("invalid schema: %s", err)
+    }
+
+    comp := New()
+    err = comp.Compile(parse(`let x = 1; let s = "a;b"; let x = x + 70000; if (x > 1) { s } else { "${x}" }`))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    programs := []*Bytecode{
+        comp.Bytecode(),
+        {
+            Instructions: concatInstructions([]code.Instructions{
+                code.Make(code.OpJumpTable, 0),
+                code.Make(code.OpConst, 70000),
+            }),
+            Handlers: []Handler{{Start: 0, End: 3, Target: 3, StackDepth: 1}},
+            JumpTables: []JumpTable{{Min: -1, Targets: []int{3}, Default: 9}},
+        },
+        {},
+    }
+
+    for i, bc := range programs {
+        out, err := json.Marshal(bc)
+        if err != nil {
+            t.Fatalf("marshal error: %s", err)
+        }
+        var doc interface{}
+        json.Unmarshal(out, &doc)
+        err = validate(schema, schema, doc, "")
+        if err != nil {
+            t.Errorf("program %d does not match the schema: %s\n%s", i, err, out)
+        }
+    }
+
+    // the validator does reject
+    bad := []string{
+        `{"schemaVersion":1,"instructions":[],"constants":[],"handlers":[],"jumpTables":[]}`,
+        `{"schemaVersion":2,"instructions":[],"constants":[],"handlers":[],"jumpTables":[],"lines":[]}`,
+        `{"schemaVersion":1,"instructions":[{"offset":0,"op":"OpPop","operands":[],"width":0}],"constants":[],"handlers":[],"jumpTables":[],"lines":[]}`,
+        `{"schemaVersion":1,"instructions":[],"constants":[{"index":0,"type":"ARRAY","value":1}],"handlers":[],"jumpTables":[],"lines":[]}`,
+        `{"schemaVersion":1,"instructions":[],"constants":[],"handlers":[],"jumpTables":[],"lines":[],"extra":0}`,
+    }
+    for _, input := range bad {
+        var doc interface{}
+        json.Unmarshal([]byte(input), &doc)
+        if validate(schema, schema, doc, "") == nil {
+            t.Errorf("expected %s to be rejected", input)
+        }
+    }
+}
+
+// The part of JSON Schema the bytecode schema uses: $ref into $defs,
+// type, const, enum, minimum, properties, required,
+// additionalProperties: false and items.
+func validate(root, schema map[string]interface{}, doc interface{}, path string) error {
+    if ref, ok := schema["$ref"].(string); ok {
+        def, ok := root["$defs"].(map[string]interface{})[strings.TrimPrefix(ref, "#/$defs/")]
+        if !ok {
+            return fmt.Errorf("%s: unknown $ref %s", path, ref)
+        }
+        return validate(root, def.(map[string]interface{}), doc, path)
+    }
+
+    if types, ok := schema["type"]; ok {
+        names := []interface{}{types}
+        if list, ok := types.([]interface{}); ok {
+            names = list
+        }
+        matched := false
+        for _, name := range names {
+            matched = matched || hasJSONType(doc, name.(string))
+        }
+        if !matched {
+            return fmt.Errorf("%s: %v is not of type %v", path, doc, types)
+        }
+    }
+    if c, ok := schema["const"]; ok && doc != c {
+        return fmt.Errorf("%s: %v is not %v", path, doc, c)
+    }
+    if enum, ok := schema["enum"].([]interface{}); ok {
+        found := false
+        for _, e := range enum {
+            found = found || doc == e
+        }
+        if !found {
+            return fmt.Errorf("%s: %v is not one of %v", path, doc, enum)
+        }
+    }
+    if min, ok := schema["minimum"].(float64); ok {
+        if n, ok := doc.(float64); ok && n < min {
+            return fmt.Errorf("%s: %v is less than %v", path, n, min)
+        }
+    }
+
+    if obj, ok := doc.(map[string]interface{}); ok {
+        properties, _ := schema["properties"].(map[string]interface{})
+        required, _ := schema["required"].([]interface{})
+        for _, name := range required {
+            if _, ok := obj[name.(string)]; !ok {
+                return fmt.Errorf("%s: %s is missing", path, name)
+            }
+        }
+        for name, value := range obj {
+            property, ok := properties[name]
+            if !ok {
+                if schema["additionalProperties"] == false {
+                    return fmt.Errorf("%s: unexpected %s", path, name)
+                }
+                continue
+            }
+            err := validate(root, property.(map[string]interface{}), value, path + "." + name)
+            if err != nil {
+                return err
+            }
+        }
+    }
+
+    if list, ok := doc.([]interface{}); ok {
+        if items, ok := schema["items"].(map[string]interface{}); ok {
+            for i, item := range list {
+                err := validate(root, items, item, fmt.Sprintf("%s[%d]", path, i))
+                if err != nil {
+                    return err
+                }
+            }
+        }
+    }
+
+    return nil
+}
+
+func hasJSONType(doc interface{}, name string) bool {
+    switch doc := doc.(type) {
+    case map[string]interface{}:
+        return name == "object"
+    case []interface{}:
+        return name == "array"
+    case string:
+        return name == "string"
+    case float64:
+        return name == "number" || name == "integer" && doc == float64(int64(doc))
+    }
+    return false
+}
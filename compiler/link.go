@@ -0,0 +1,155 @@
+package compiler
+
+import (
+    "fmt"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+// Link units into one program that runs them in order.
+// Each unit's globals get final indexes: an export keeps its name, an
+// import takes the index of the export of an earlier unit, and private
+// globals get indexes of their own. A unit that defines a name again
+// shadows the earlier export for the units after it, like a second let
+// in one file. Constant pools are merged, sharing
+// equal integers and strings. Jumps, handlers and jump tables move with
+// the code, and operands that grow past 2 bytes are made wide.
+func Link(units ...*Unit) (*Bytecode, error) {
+    merged := &Bytecode{
+        Constants: []object.Object{},
+        Handlers: []Handler{},
+        JumpTables: []JumpTable{},
+        Globals: []string{},
+    }
+    constantIndex := make(map[ConstantKey]int)
+    // name -> final index of the latest export
+    exported := make(map[string]int)
+
+    insts := []*peepholeInst{}
+    // the units' code one after another, the positions before relocation
+    base := 0
+
+    for _, u := range units {
+        globals := make([]int, u.NumGlobals)
+        imported := make(map[int]bool)
+        for _, name := range sortedNames(u.Imports) {
+            index, ok := exported[name]
+            if !ok {
+                return nil, fmt.Errorf("%s: %s is not defined by an earlier unit", u.Name, name)
+            }
+            globals[u.Imports[name]] = index
+            imported[u.Imports[name]] = true
+        }
+        for i := range globals {
+            if !imported[i] {
+                globals[i] = len(merged.Globals)
+                merged.Globals = append(merged.Globals, "")
+            }
+        }
+        for _, name := range sortedNames(u.Exports) {
+            if shadowed, ok := exported[name]; ok {
+                merged.Globals[shadowed] = ""
+            }
+            index := globals[u.Exports[name]]
+            exported[name] = index
+            merged.Globals[index] = name
+        }
+        if len(merged.Globals) > MaxGlobals {
+            return nil, fmt.Errorf("too many globals: the limit is %d", MaxGlobals)
+        }
+
+        constants := make([]int, len(u.Bytecode.Constants))
+        for i, obj := range u.Bytecode.Constants {
+            key, ok := KeyOfConstant(obj)
+            if ok {
+                if index, exists := constantIndex[key]; exists {
+                    constants[i] = index
+                    continue
+                }
+                constantIndex[key] = len(merged.Constants)
+            }
+            constants[i] = len(merged.Constants)
+            merged.Constants = append(merged.Constants, obj)
+        }
+
+        tableBase := len(merged.JumpTables)
+
+        unitInsts, err := code.Decode(u.Bytecode.Instructions)
+        if err != nil {
+            return nil, fmt.Errorf("%s: %s", u.Name, err)
+        }
+        for _, inst := range unitInsts {
+            def, _ := code.Lookup(byte(inst.Op))
+            operands := make([]int, len(inst.Operands))
+            for j, operand := range inst.Operands {
+                var limit int
+                switch def.OperandKind(j) {
+                case code.OperandConstant:
+                    limit = len(constants)
+                case code.OperandGlobal:
+                    limit = len(globals)
+                case code.OperandTable:
+                    limit = len(u.Bytecode.JumpTables)
+                case code.OperandTarget:
+                    limit = len(u.Bytecode.Instructions) + 1
+                default:
+                    operands[j] = operand
+                    continue
+                }
+                if operand >= limit {
+                    return nil, fmt.Errorf("%s: at %04d: operand %d of %s out of range",
+                        u.Name, inst.Offset, operand, def.Name)
+                }
+
+                switch def.OperandKind(j) {
+                case code.OperandConstant:
+                    operands[j] = constants[operand]
+                case code.OperandGlobal:
+                    operands[j] = globals[operand]
+                case code.OperandTable:
+                    operands[j] = tableBase + operand
+                case code.OperandTarget:
+                    operands[j] = base + operand
+                }
+            }
+            insts = append(insts, &peepholeInst{Op: inst.Op, Operands: operands, Position: base + inst.Offset})
+        }
+
+        for _, h := range u.Bytecode.Handlers {
+            merged.Handlers = append(merged.Handlers, Handler{
+                Start: base + h.Start,
+                End: base + h.End,
+                Target: base + h.Target,
+                StackDepth: h.StackDepth,
+            })
+        }
+        for _, table := range u.Bytecode.JumpTables {
+            targets := make([]int, len(table.Targets))
+            for i, t := range table.Targets {
+                targets[i] = base + t
+            }
+            merged.JumpTables = append(merged.JumpTables, JumpTable{
+                Min: table.Min,
+                Targets: targets,
+                Default: base + table.Default,
+            })
+        }
+
+        base += len(u.Bytecode.Instructions)
+    }
+
+    // the end of a unit is where the next one starts
+    p := &peephole{insts: insts, size: base, bc: merged, index: make(map[int]int)}
+    for i, inst := range insts {
+        p.index[inst.Position] = i
+    }
+    linked := p.assemble()
+
+    if len(linked.Constants) - 1 > code.MaxWideOperand {
+        return nil, fmt.Errorf("too many constants: the limit is %d", code.MaxWideOperand + 1)
+    }
+    if len(linked.Instructions) > code.MaxWideOperand {
+        return nil, fmt.Errorf("program too large: the limit is %d bytes of instructions", code.MaxWideOperand)
+    }
+    return linked, nil
+}
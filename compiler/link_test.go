@@ -0,0 +1,199 @@
+package compiler
+
+import (
+    "path/filepath"
+    "reflect"
+    "testing"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+func TestCompileUnit(t *testing.T) {
+    u, err := CompileUnit("main", parse(`let x = one + 1; let one = x; one`), Options{})
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+
+    // one is imported as 0 and defined again as 2
+    if !reflect.DeepEqual(u.Imports, map[string]int{"one": 0}) {
+        t.Errorf("wrong imports. got=%v", u.Imports)
+    }
+    if !reflect.DeepEqual(u.Exports, map[string]int{"x": 1, "one": 2}) {
+        t.Errorf("wrong exports. got=%v", u.Exports)
+    }
+    if u.NumGlobals != 3 {
+        t.Errorf("wrong number of globals. want=3, got=%d", u.NumGlobals)
+    }
+}
+
+func TestLink(t *testing.T) {
+    lib := compileUnit(t, "lib", `let one = 1; let greeting = "hi"`)
+    main := compileUnit(t, "main", `let x = one + 1; if (x > 1) { greeting } else { "no" }`)
+
+    bc, err := Link(lib, main)
+    if err != nil {
+        t.Fatalf("link error: %s", err)
+    }
+
+    expected := `.constants
+    0 1
+    1 "hi"
+    2 "no"
+.code
+0000    OpConst 0                ; 1
+0003    OpSetGlobal 0
+0006    OpConst 1                ; "hi"
+0009    OpSetGlobal 1
+0012    OpGetGlobal 0
+0015    OpConst 0                ; 1
+0018    OpAdd
+0019    OpSetGlobal 2
+0022    OpGetGlobal 2
+0025    OpConst 0                ; 1
+0028    OpGT
+0029    OpJumpNotTruthy L0
+0032    OpGetGlobal 1
+0035    OpJump L1
+L0:
+0038    OpConst 2                ; "no"
+L1:
+0041    OpPop
+`
+    if got := Disassemble(bc); got != expected {
+        t.Errorf("wrong linked program.\nwant=%s\ngot=%s", expected, got)
+    }
+    if !reflect.DeepEqual(bc.Globals, []string{"one", "greeting", "x"}) {
+        t.Errorf("wrong globals. got=%v", bc.Globals)
+    }
+}
+
+// A unit defining a name again shadows the earlier export, as a second
+// let does within a file.
+func TestLinkShadowing(t *testing.T) {
+    lib := compileUnit(t, "lib", `let n = 1; let helper = 2; let libN = n`)
+    main := compileUnit(t, "main", `let n = 10; n + libN`)
+    // helper is imported from lib, then defined again
+    late := compileUnit(t, "late", `helper; let helper = 3`)
+
+    if !reflect.DeepEqual(late.Imports, map[string]int{"helper": 0}) {
+        t.Errorf("wrong imports. got=%v", late.Imports)
+    }
+
+    bc, err := Link(lib, main, late)
+    if err != nil {
+        t.Fatalf("link error: %s", err)
+    }
+
+    // lib's n and helper are shadowed
+    expected := []string{"", "", "libN", "n", "helper"}
+    if !reflect.DeepEqual(bc.Globals, expected) {
+        t.Errorf("wrong globals. want=%q, got=%q", expected, bc.Globals)
+    }
+
+    insts, err := code.Decode(bc.Instructions)
+    if err != nil {
+        t.Fatalf("decode error: %s", err)
+    }
+    // late's helper; reads lib's global, its let stores to a new one
+    tail := insts[len(insts) - 4:]
+    if tail[0].Op != code.OpGetGlobal || tail[0].Operands[0] != 1 ||
+        tail[3].Op != code.OpSetGlobal || tail[3].Operands[0] != 4 {
+        t.Errorf("wrong globals in late's code. got=%v", tail)
+    }
+}
+
+func TestLinkTables(t *testing.T) {
+    // a handler and a jump table in the second unit move with its code
+    u := &Unit{
+        Name: "tables",
+        Bytecode: &Bytecode{
+            Instructions: concatInstructions([]code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpJumpTable, 0),
+                code.Make(code.OpThrow),
+            }),
+            Constants: []object.Object{&object.Integer{Value: 1}},
+            Handlers: []Handler{{Start: 0, End: 6, Target: 7, StackDepth: 0}},
+            JumpTables: []JumpTable{{Min: 1, Targets: []int{6}, Default: 7}},
+        },
+        Exports: map[string]int{},
+        Imports: map[string]int{},
+    }
+
+    bc, err := Link(compileUnit(t, "first", "1"), u)
+    if err != nil {
+        t.Fatalf("link error: %s", err)
+    }
+
+    if !reflect.DeepEqual(bc.Handlers, []Handler{{Start: 4, End: 10, Target: 11, StackDepth: 0}}) {
+        t.Errorf("wrong handlers. got=%v", bc.Handlers)
+    }
+    if !reflect.DeepEqual(bc.JumpTables, []JumpTable{{Min: 1, Targets: []int{10}, Default: 11}}) {
+        t.Errorf("wrong jump tables. got=%v", bc.JumpTables)
+    }
+}
+
+func TestLinkErrors(t *testing.T) {
+    lib := compileUnit(t, "lib", `let one = 1; let greeting = "hi"`)
+    main := compileUnit(t, "main", `one + 1`)
+    broken := &Unit{
+        Name: "broken",
+        Bytecode: &Bytecode{Instructions: code.Make(code.OpGetGlobal, 1), Constants: []object.Object{}},
+        Exports: map[string]int{},
+        Imports: map[string]int{},
+        NumGlobals: 1,
+    }
+
+    tests := []struct {
+        units []*Unit
+        expected string
+    }{
+        {[]*Unit{main}, "main: one is not defined by an earlier unit"},
+        {[]*Unit{main, lib}, "main: one is not defined by an earlier unit"},
+        {[]*Unit{broken}, "broken: at 0000: operand 1 of OpGetGlobal out of range"},
+    }
+
+    for _, test := range tests {
+        _, err := Link(test.units...)
+        if err == nil || err.Error() != test.expected {
+            t.Errorf("wrong error. want=%q, got=%v", test.expected, err)
+        }
+    }
+}
+
+func TestUnitSaveAndLoad(t *testing.T) {
+    u := compileUnit(t, "main", `let x = one + "${two}"; x`)
+
+    path := filepath.Join(t.TempDir(), "main" + UnitFileExtension)
+    err := u.Save(path)
+    if err != nil {
+        t.Fatalf("save error: %s", err)
+    }
+    loaded, err := LoadUnit(path)
+    if err != nil {
+        t.Fatalf("load error: %s", err)
+    }
+
+    if loaded.Name != u.Name || loaded.NumGlobals != u.NumGlobals ||
+        !reflect.DeepEqual(loaded.Exports, u.Exports) || !reflect.DeepEqual(loaded.Imports, u.Imports) {
+        t.Errorf("wrong unit. want=%+v, got=%+v", u, loaded)
+    }
+    testSameBytecode(t, u.Bytecode, loaded.Bytecode)
+
+    // a program is not a unit
+    data, _ := u.Bytecode.MarshalBinary()
+    err = (&Unit{}).UnmarshalBinary(data)
+    if err == nil || err.Error() != "not a monkey unit file" {
+        t.Errorf("expected a not a unit error. got=%v", err)
+    }
+}
+
+func compileUnit(t *testing.T, name string, input string) *Unit {
+    t.Helper()
+
+    u, err := CompileUnit(name, parse(input), Options{})
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    return u
+}
@@ -0,0 +1,381 @@
+package compiler
+
+import (
+    "monkey_compiler/code"
+)
+
+// An instruction decoded for the peephole pass.
+// Jump operands keep pointing at positions in the original instructions
+// until the pass is finished and everything is relocated at once.
+type peepholeInst struct {
+    Op code.Opcode
+    Operands []int
+    Position int
+    Removed bool
+}
+
+// Opcodes that push one value and have no other effect.
+func isPurePush(op code.Opcode) bool {
+    def, err := code.Lookup(byte(op))
+    return err == nil && def.Pops == 0 && def.Pushes == 1 && def.Flags == 0
+}
+
+// Optimize bc and return the result. rewrite runs the peephole rewrites,
+// superinstructions the selection of fused opcodes.
+// Handler and jump table positions are relocated together with the jumps.
+// wideJumps holds the targets of jumps at these positions that didn't fit
+// in their operand, the assembly gives them wide ones.
+func optimize(bc *Bytecode, rewrite bool, superinstructions bool, wideJumps map[int]int) *Bytecode {
+    insts := decodeForPeephole(bc.Instructions)
+    p := &peephole{insts: insts, size: len(bc.Instructions), bc: bc, index: make(map[int]int)}
+    for i, inst := range insts {
+        p.index[inst.Position] = i
+        if target, ok := wideJumps[inst.Position]; ok {
+            inst.Operands[0] = target
+        }
+    }
+
+    if rewrite {
+        for p.pass() {
+        }
+    }
+    if superinstructions {
+        p.fuse()
+    }
+
+    return p.assemble()
+}
+
+func decodeForPeephole(ins code.Instructions) []*peepholeInst {
+    insts := []*peepholeInst{}
+
+    d := code.NewDecoder(ins)
+    for d.Next() {
+        inst := d.Instruction()
+        insts = append(insts, &peepholeInst{Op: inst.Op, Operands: inst.Operands, Position: inst.Offset})
+    }
+    if d.Err() != nil {
+        // leave undecodable code alone
+        return []*peepholeInst{}
+    }
+
+    return insts
+}
+
+type peephole struct {
+    insts []*peepholeInst
+    size int
+    bc *Bytecode
+
+    // position -> index in insts
+    index map[int]int
+    // resolved jump targets of the current pass
+    targets map[int]bool
+}
+
+// The first live instruction at or after pos, or size at the end.
+func (p *peephole) resolve(pos int) int {
+    i, ok := p.index[pos]
+    if !ok {
+        return p.size
+    }
+    for ; i < len(p.insts); i++ {
+        if !p.insts[i].Removed {
+            return p.insts[i].Position
+        }
+    }
+    return p.size
+}
+
+// Remove an instruction. Jumps that arrived at it now arrive at the next
+// live instruction, so that one becomes a target.
+func (p *peephole) remove(inst *peepholeInst) {
+    inst.Removed = true
+    if p.targets[inst.Position] {
+        p.targets[p.resolve(inst.Position)] = true
+    }
+}
+
+func (p *peephole) live() []*peepholeInst {
+    live := []*peepholeInst{}
+    for _, inst := range p.insts {
+        if !inst.Removed {
+            live = append(live, inst)
+        }
+    }
+    return live
+}
+
+// Positions control can arrive at other than by falling through, plus
+// the boundaries of protected regions. Rewrites never merge across them.
+func (p *peephole) findTargets() map[int]bool {
+    targets := map[int]bool{}
+
+    for _, inst := range p.insts {
+        if !inst.Removed && code.Has(inst.Op, code.Jump) {
+            targets[p.resolve(inst.Operands[0])] = true
+        }
+    }
+    for _, h := range p.bc.Handlers {
+        targets[p.resolve(h.Start)] = true
+        targets[p.resolve(h.End)] = true
+        targets[p.resolve(h.Target)] = true
+    }
+    for _, table := range p.bc.JumpTables {
+        for _, t := range table.Targets {
+            targets[p.resolve(t)] = true
+        }
+        targets[p.resolve(table.Default)] = true
+    }
+
+    return targets
+}
+
+// One round of rewrites. Returns true if anything changed.
+func (p *peephole) pass() bool {
+    changed := p.threadJumps()
+
+    p.targets = p.findTargets()
+    targets := p.targets
+    live := p.live()
+
+    for i := 0; i < len(live); i++ {
+        inst := live[i]
+        if inst.Removed {
+            continue
+        }
+
+        var next, nextNext *peepholeInst
+        if i + 1 < len(live) {
+            next = live[i + 1]
+        }
+        if i + 2 < len(live) {
+            nextNext = live[i + 2]
+        }
+
+        switch {
+        // the condition is always truthy, so the jump is never taken
+        case inst.Op == code.OpTrue && next != nil && next.Op == code.OpJumpNotTruthy &&
+            !targets[next.Position]:
+            p.remove(inst)
+            p.remove(next)
+            changed = true
+
+        // the condition is never truthy, so the jump is always taken
+        case inst.Op == code.OpFalse && next != nil && next.Op == code.OpJumpNotTruthy &&
+            !targets[next.Position]:
+            p.remove(inst)
+            next.Op = code.OpJump
+            changed = true
+
+        // a value pushed only to be popped again. The last OpPop is kept,
+        // its value is what LastPoppedStackElem reports.
+        case isPurePush(inst.Op) && next != nil && next.Op == code.OpPop &&
+            !targets[next.Position] && hasPopAfter(live[i + 2:]):
+            p.remove(inst)
+            p.remove(next)
+            changed = true
+
+        // !!x only normalizes x to a Boolean, a conditional jump doesn't care
+        case inst.Op == code.OpBang && next != nil && next.Op == code.OpBang &&
+            nextNext != nil && nextNext.Op == code.OpJumpNotTruthy &&
+            !targets[next.Position] && !targets[nextNext.Position]:
+            p.remove(inst)
+            p.remove(next)
+            changed = true
+
+        // a jump to the instruction right after it
+        case inst.Op == code.OpJump && p.resolve(inst.Operands[0]) == p.nextPosition(live, i):
+            p.remove(inst)
+            changed = true
+
+        // code after an unconditional transfer that no jump arrives at
+        case code.Has(inst.Op, code.NoFallthrough):
+            for j := i + 1; j < len(live) && !targets[live[j].Position]; j++ {
+                p.remove(live[j])
+                changed = true
+            }
+        }
+    }
+
+    return changed
+}
+
+func (p *peephole) nextPosition(live []*peepholeInst, i int) int {
+    if i + 1 < len(live) {
+        return live[i + 1].Position
+    }
+    return p.size
+}
+
+func hasPopAfter(insts []*peepholeInst) bool {
+    for _, inst := range insts {
+        if !inst.Removed && inst.Op == code.OpPop {
+            return true
+        }
+    }
+    return false
+}
+
+// Replace hot sequences with a single fused opcode.
+// Runs once after the other rewrites, they don't know the fused opcodes.
+func (p *peephole) fuse() {
+    targets := p.findTargets()
+    live := p.live()
+
+    for i := 0; i < len(live); i++ {
+        inst := live[i]
+
+        var next, nextNext *peepholeInst
+        if i + 1 < len(live) && !targets[live[i + 1].Position] {
+            next = live[i + 1]
+        }
+        if next != nil && i + 2 < len(live) && !targets[live[i + 2].Position] {
+            nextNext = live[i + 2]
+        }
+
+        switch {
+        case inst.Op == code.OpGetGlobal && next != nil && next.Op == code.OpConst &&
+            nextNext != nil && nextNext.Op == code.OpAdd:
+            inst.Op = code.OpGetGlobalConstAdd
+            inst.Operands = []int{inst.Operands[0], next.Operands[0]}
+            next.Removed = true
+            nextNext.Removed = true
+            i += 2
+
+        case inst.Op == code.OpConst && next != nil && next.Op == code.OpGT:
+            inst.Op = code.OpConstGT
+            next.Removed = true
+            i += 1
+
+        case inst.Op == code.OpGetGlobal && next != nil && next.Op == code.OpIndex:
+            inst.Op = code.OpGetGlobalIndex
+            next.Removed = true
+            i += 1
+        }
+    }
+}
+
+// Point jumps that land on an unconditional jump at its destination.
+func (p *peephole) threadJumps() bool {
+    changed := false
+
+    for _, inst := range p.insts {
+        if inst.Removed || !code.Has(inst.Op, code.Jump) {
+            continue
+        }
+
+        seen := map[int]bool{}
+        dst := p.resolve(inst.Operands[0])
+        for !seen[dst] {
+            seen[dst] = true
+            target := p.instAt(dst)
+            if target == nil || target.Op != code.OpJump {
+                break
+            }
+            dst = p.resolve(target.Operands[0])
+        }
+
+        if dst != p.resolve(inst.Operands[0]) {
+            inst.Operands[0] = dst
+            changed = true
+        }
+    }
+
+    return changed
+}
+
+func (p *peephole) instAt(pos int) *peepholeInst {
+    i, ok := p.index[pos]
+    if !ok {
+        return nil
+    }
+    return p.insts[i]
+}
+
+// Encode the live instructions and relocate every position.
+// A jump gets a wide operand when its target moves past MaxOperand, which
+// moves the targets after it: the sizes are recomputed until they settle.
+// Instructions only ever grow, so that terminates.
+func (p *peephole) assemble() *Bytecode {
+    sizes := make(map[*peepholeInst]int)
+    for _, inst := range p.insts {
+        if code.Has(inst.Op, code.Jump) {
+            sizes[inst] = len(code.Make(inst.Op, 0))
+        } else {
+            sizes[inst] = len(code.Make(inst.Op, inst.Operands...))
+        }
+    }
+
+    var newPos map[int]int
+    relocate := func(old int) int {
+        return newPos[p.resolve(old)]
+    }
+
+    for {
+        newPos = make(map[int]int)
+        pos := 0
+        for _, inst := range p.insts {
+            if inst.Removed {
+                continue
+            }
+            newPos[inst.Position] = pos
+            pos += sizes[inst]
+        }
+        newPos[p.size] = pos
+
+        changed := false
+        for _, inst := range p.insts {
+            if inst.Removed || !code.Has(inst.Op, code.Jump) {
+                continue
+            }
+            size := len(code.Make(inst.Op, relocate(inst.Operands[0])))
+            if size > sizes[inst] {
+                sizes[inst] = size
+                changed = true
+            }
+        }
+        if !changed {
+            break
+        }
+    }
+
+    out := code.Instructions{}
+    for _, inst := range p.insts {
+        if inst.Removed {
+            continue
+        }
+        operands := inst.Operands
+        if code.Has(inst.Op, code.Jump) {
+            operands = []int{relocate(inst.Operands[0])}
+        }
+        out = append(out, code.Make(inst.Op, operands...)...)
+    }
+
+    handlers := []Handler{}
+    for _, h := range p.bc.Handlers {
+        handlers = append(handlers, Handler{
+            Start: relocate(h.Start),
+            End: relocate(h.End),
+            Target: relocate(h.Target),
+            StackDepth: h.StackDepth,
+        })
+    }
+
+    tables := []JumpTable{}
+    for _, table := range p.bc.JumpTables {
+        targets := make([]int, len(table.Targets))
+        for i, t := range table.Targets {
+            targets[i] = relocate(t)
+        }
+        tables = append(tables, JumpTable{Min: table.Min, Targets: targets, Default: relocate(table.Default)})
+    }
+
+    return &Bytecode{
+        Instructions: out,
+        Constants: p.bc.Constants,
+        Handlers: handlers,
+        JumpTables: tables,
+        Globals: p.bc.Globals,
+    }
+}
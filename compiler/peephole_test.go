@@ -0,0 +1,202 @@
+package compiler
+
+import (
+    "testing"
+    "monkey_compiler/code"
+)
+
+func TestPeepholeCompiled(t *testing.T) {
+    tests := []compilerTestCase {
+        {
+            input : `
+            if (true) { 10 }; 3333;
+            `,
+            expectedConstants: []interface{}{10, 3333},
+            expectedInstructions: []code.Instructions {
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input : `
+            if (false) { 10 } else { 20 };
+            `,
+            expectedConstants: []interface{}{10, 20},
+            expectedInstructions: []code.Instructions {
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input : `
+            1; 2; 3;
+            `,
+            expectedConstants: []interface{}{1, 2, 3},
+            expectedInstructions: []code.Instructions {
+                code.Make(code.OpConst, 2),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input : `
+            let x = 1; if (!!x) { 10 } else { 20 };
+            `,
+            expectedConstants: []interface{}{1, 10, 20},
+            expectedInstructions: []code.Instructions {
+                // 0000
+                code.Make(code.OpConst, 0),
+                // 0003
+                code.Make(code.OpSetGlobal, 0),
+                // 0006
+                code.Make(code.OpGetGlobal, 0),
+                // 0009
+                code.Make(code.OpJumpNotTruthy, 18),
+                // 0012
+                code.Make(code.OpConst, 1),
+                // 0015
+                code.Make(code.OpJump, 21),
+                // 0018
+                code.Make(code.OpConst, 2),
+                // 0021
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    runCompilerTestWithOptions(t, Options{Peephole: true}, tests)
+}
+
+func TestPeepholeRelocation(t *testing.T) {
+    // 0000 OpGetGlobal 0
+    // 0003 OpJumpNotTruthy 12
+    // 0006 OpConst 0
+    // 0009 OpJump 19     <- lands on another jump
+    // 0012 OpConst 1
+    // 0015 OpConst 1     <- dropped with the OpPop after it
+    // 0018 OpPop
+    // 0019 OpJump 23     <- jumps to the next instruction once 0022 is gone
+    // 0022 OpNull        <- unreachable
+    // 0023 OpConst 0
+    // 0026 OpPop
+    bc := &Bytecode{
+        Instructions: concatInstructions([]code.Instructions{
+            code.Make(code.OpGetGlobal, 0),
+            code.Make(code.OpJumpNotTruthy, 12),
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpJump, 19),
+            code.Make(code.OpConst, 1),
+            code.Make(code.OpConst, 1),
+            code.Make(code.OpPop),
+            code.Make(code.OpJump, 23),
+            code.Make(code.OpNull),
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpPop),
+        }),
+        Handlers: []Handler{
+            {Start: 0, End: 19, Target: 23, StackDepth: 0},
+        },
+        JumpTables: []JumpTable{
+            {Min: 0, Targets: []int{12}, Default: 19},
+        },
+    }
+
+    optimized := optimize(bc, true, false, nil)
+
+    expected := []code.Instructions{
+        // 0000
+        code.Make(code.OpGetGlobal, 0),
+        // 0003
+        code.Make(code.OpJumpNotTruthy, 12),
+        // 0006
+        code.Make(code.OpConst, 0),
+        // 0009
+        code.Make(code.OpJump, 15),
+        // 0012
+        code.Make(code.OpConst, 1),
+        // 0015
+        code.Make(code.OpConst, 0),
+        // 0018
+        code.Make(code.OpPop),
+    }
+
+    err := testInstructions(expected, optimized.Instructions)
+    if err != nil {
+        t.Fatalf("testInstructions failed: %s", err)
+    }
+
+    h := optimized.Handlers[0]
+    if h.Start != 0 || h.End != 15 || h.Target != 15 {
+        t.Errorf("handler not relocated. got=%+v", h)
+    }
+    table := optimized.JumpTables[0]
+    if table.Targets[0] != 12 || table.Default != 15 {
+        t.Errorf("jump table not relocated. got=%+v", table)
+    }
+}
+
+func TestSuperinstructions(t *testing.T) {
+    tests := []compilerTestCase {
+        {
+            input: "let x = 1; x + 2",
+            expectedConstants: []interface{}{1, 2},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpGetGlobalConstAdd, 0, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "let x = 1; x > 2",
+            expectedConstants: []interface{}{1, 2},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpGetGlobal, 0),
+                code.Make(code.OpConstGT, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            input: "let a = [1]; let i = 0; a[i]",
+            expectedConstants: []interface{}{1, 0},
+            expectedInstructions: []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpArray, 1),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpSetGlobal, 1),
+                code.Make(code.OpGetGlobal, 0),
+                code.Make(code.OpGetGlobalIndex, 1),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            // the OpConst is a jump target, so it can't be fused
+            input: "let x = 1; (if (x) { x } else { 0 }) > 2",
+            expectedConstants: []interface{}{1, 0, 2},
+            expectedInstructions: []code.Instructions{
+                // 0000
+                code.Make(code.OpConst, 0),
+                // 0003
+                code.Make(code.OpSetGlobal, 0),
+                // 0006
+                code.Make(code.OpGetGlobal, 0),
+                // 0009
+                code.Make(code.OpJumpNotTruthy, 18),
+                // 0012
+                code.Make(code.OpGetGlobal, 0),
+                // 0015
+                code.Make(code.OpJump, 21),
+                // 0018
+                code.Make(code.OpConst, 1),
+                // 0021
+                code.Make(code.OpConstGT, 2),
+                // 0024
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    runCompilerTestWithOptions(t, Options{Superinstructions: true}, tests)
+}
@@ -0,0 +1,357 @@
+package compiler
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io/ioutil"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+// The .mbc file format, all numbers big endian like the instructions:
+//
+//     magic        4 bytes  "\x7fMBC"
+//     version      uint16
+//     reserved     uint16   0
+//     opcodes      uint32   code.Fingerprint() of the compiler
+//     instructions uint32 length, then the bytes
+//     constants    uint32 count, then per constant a tag byte and
+//                    tagInteger  int64
+//                    tagString   uint32 length, then the bytes
+//     handlers     uint32 count, then Start, End, Target, StackDepth as uint32
+//     jump tables  uint32 count, then per table Min as int64, uint32
+//                  count of Targets, the Targets and Default as uint32
+//     checksum     uint32 CRC-32 (IEEE) of everything before it
+//
+// The pool only ever holds integers and strings: booleans and null have
+// their own opcodes, and the language has no functions to compile yet.
+// A file whose opcode fingerprint differs from this binary's is rejected:
+// its opcode numbers would mean other opcodes here.
+
+const FileExtension = ".mbc"
+
+const FormatVersion = 2
+
+var magic = []byte("\x7fMBC")
+
+const (
+    tagInteger byte = iota + 1
+    tagString
+)
+
+func (bc *Bytecode) MarshalBinary() ([]byte, error) {
+    var out bytes.Buffer
+    w := &binaryWriter{out: &out}
+
+    out.Write(magic)
+    w.uint16(FormatVersion)
+    w.uint16(0)
+    w.uint32(int(code.Fingerprint()))
+
+    w.uint32(len(bc.Instructions))
+    out.Write(bc.Instructions)
+
+    w.uint32(len(bc.Constants))
+    for _, c := range bc.Constants {
+        switch c := c.(type) {
+        case *object.Integer:
+            out.WriteByte(tagInteger)
+            w.int64(c.Value)
+        case *object.String:
+            out.WriteByte(tagString)
+            w.uint32(len(c.Value))
+            out.WriteString(c.Value)
+        default:
+            return nil, fmt.Errorf("cannot serialize constant of type %s", c.Type())
+        }
+    }
+
+    w.uint32(len(bc.Handlers))
+    for _, h := range bc.Handlers {
+        w.uint32(h.Start)
+        w.uint32(h.End)
+        w.uint32(h.Target)
+        w.uint32(h.StackDepth)
+    }
+
+    w.uint32(len(bc.JumpTables))
+    for _, table := range bc.JumpTables {
+        w.int64(table.Min)
+        w.uint32(len(table.Targets))
+        for _, t := range table.Targets {
+            w.uint32(t)
+        }
+        w.uint32(table.Default)
+    }
+
+    if w.err != nil {
+        return nil, w.err
+    }
+
+    w.uint32(int(crc32.ChecksumIEEE(out.Bytes())))
+    return out.Bytes(), nil
+}
+
+func (bc *Bytecode) UnmarshalBinary(data []byte) error {
+    if len(data) < len(magic) || !bytes.Equal(data[:len(magic)], magic) {
+        return fmt.Errorf("not a monkey bytecode file")
+    }
+    if len(data) < len(magic) + 4 + 4 + 4 {
+        return fmt.Errorf("bytecode truncated")
+    }
+
+    body, sum := data[:len(data) - 4], binary.BigEndian.Uint32(data[len(data) - 4:])
+    r := &binaryReader{data: body, pos: len(magic)}
+
+    version := r.uint16()
+    if version != FormatVersion {
+        return fmt.Errorf("unsupported bytecode version %d, expected %d", version, FormatVersion)
+    }
+    if crc32.ChecksumIEEE(body) != sum {
+        return fmt.Errorf("bytecode checksum mismatch")
+    }
+    r.uint16()
+    if fp := uint32(r.uint32()); fp != code.Fingerprint() {
+        return fmt.Errorf("bytecode built for another opcode table (fingerprint %08x, expected %08x), rebuild it from source",
+            fp, code.Fingerprint())
+    }
+
+    result := Bytecode{}
+    result.Instructions = r.bytes(r.uint32())
+
+    n := r.uint32()
+    result.Constants = make([]object.Object, 0, r.capacity(n))
+    for i := 0; i < n && r.err == nil; i++ {
+        switch tag := r.byte(); tag {
+        case tagInteger:
+            result.Constants = append(result.Constants, &object.Integer{Value: r.int64()})
+        case tagString:
+            s := r.bytes(r.uint32())
+            result.Constants = append(result.Constants, &object.String{Value: string(s)})
+        default:
+            if r.err == nil {
+                r.err = fmt.Errorf("unknown constant tag %d", tag)
+            }
+        }
+    }
+
+    n = r.uint32()
+    result.Handlers = make([]Handler, 0, r.capacity(n))
+    for i := 0; i < n && r.err == nil; i++ {
+        result.Handlers = append(result.Handlers, Handler{
+            Start: r.uint32(),
+            End: r.uint32(),
+            Target: r.uint32(),
+            StackDepth: r.uint32(),
+        })
+    }
+
+    n = r.uint32()
+    result.JumpTables = make([]JumpTable, 0, r.capacity(n))
+    for i := 0; i < n && r.err == nil; i++ {
+        table := JumpTable{Min: r.int64()}
+        m := r.uint32()
+        table.Targets = make([]int, 0, r.capacity(m))
+        for j := 0; j < m && r.err == nil; j++ {
+            table.Targets = append(table.Targets, r.uint32())
+        }
+        table.Default = r.uint32()
+        result.JumpTables = append(result.JumpTables, table)
+    }
+
+    if r.err != nil {
+        return r.err
+    }
+    if r.pos != len(body) {
+        return fmt.Errorf("%d unexpected bytes after the jump tables", len(body) - r.pos)
+    }
+    err := result.check()
+    if err != nil {
+        return err
+    }
+
+    *bc = result
+    return nil
+}
+
+// Check that the operands, handlers and jump tables only refer to what
+// is there, so the VM can run a loaded file without going out of range.
+// A target is the start of an instruction or the end of the code.
+func (bc *Bytecode) check() error {
+    starts := map[int]bool{len(bc.Instructions): true}
+    insts := []code.Instruction{}
+    d := code.NewDecoder(bc.Instructions)
+    for d.Next() {
+        starts[d.Instruction().Offset] = true
+        insts = append(insts, d.Instruction())
+    }
+    if d.Err() != nil {
+        return d.Err()
+    }
+
+    for _, inst := range insts {
+        def, _ := code.Lookup(byte(inst.Op))
+        for i, operand := range inst.Operands {
+            var limit int
+            switch def.OperandKind(i) {
+            case code.OperandConstant:
+                limit = len(bc.Constants)
+            case code.OperandGlobal:
+                limit = MaxGlobals
+            case code.OperandTable:
+                limit = len(bc.JumpTables)
+            case code.OperandTarget:
+                if !starts[operand] {
+                    return fmt.Errorf("at %04d: %s jumps to %d, not an instruction", inst.Offset, def.Name, operand)
+                }
+                continue
+            default:
+                continue
+            }
+            if operand >= limit {
+                return fmt.Errorf("at %04d: %s operand %d out of range, the limit is %d", inst.Offset, def.Name, operand, limit)
+            }
+        }
+    }
+
+    for i, h := range bc.Handlers {
+        if !starts[h.Start] || !starts[h.End] || h.Start > h.End || !starts[h.Target] {
+            return fmt.Errorf("handler %d: bad range %d-%d or target %d", i, h.Start, h.End, h.Target)
+        }
+    }
+    for i, table := range bc.JumpTables {
+        if !starts[table.Default] {
+            return fmt.Errorf("jump table %d: target %d is not an instruction", i, table.Default)
+        }
+        for _, target := range table.Targets {
+            if !starts[target] {
+                return fmt.Errorf("jump table %d: target %d is not an instruction", i, target)
+            }
+        }
+    }
+
+    return nil
+}
+
+// Write the bytecode to a .mbc file.
+func (bc *Bytecode) Save(path string) error {
+    data, err := bc.MarshalBinary()
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, data, 0644)
+}
+
+// Read a .mbc file.
+func Load(path string) (*Bytecode, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    bc := &Bytecode{}
+    err = bc.UnmarshalBinary(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", path, err)
+    }
+    return bc, nil
+}
+
+// The first value that doesn't fit is kept as err.
+type binaryWriter struct {
+    out *bytes.Buffer
+    err error
+}
+
+func (w *binaryWriter) uint16(v int) {
+    var b [2]byte
+    binary.BigEndian.PutUint16(b[:], uint16(v))
+    w.out.Write(b[:])
+}
+
+func (w *binaryWriter) uint32(v int) {
+    if w.err == nil && (v < 0 || v > 1<<32 - 1) {
+        w.err = fmt.Errorf("%d does not fit in the bytecode format", v)
+    }
+    var b [4]byte
+    binary.BigEndian.PutUint32(b[:], uint32(v))
+    w.out.Write(b[:])
+}
+
+func (w *binaryWriter) int64(v int64) {
+    var b [8]byte
+    binary.BigEndian.PutUint64(b[:], uint64(v))
+    w.out.Write(b[:])
+}
+
+// Reads past the end set err and give zero values.
+type binaryReader struct {
+    data []byte
+    pos int
+    err error
+}
+
+func (r *binaryReader) next(n int) []byte {
+    if r.err != nil {
+        return nil
+    }
+    if n < 0 || len(r.data) - r.pos < n {
+        r.err = fmt.Errorf("bytecode truncated")
+        return nil
+    }
+    b := r.data[r.pos:r.pos + n]
+    r.pos += n
+    return b
+}
+
+func (r *binaryReader) byte() byte {
+    b := r.next(1)
+    if b == nil {
+        return 0
+    }
+    return b[0]
+}
+
+func (r *binaryReader) uint16() int {
+    b := r.next(2)
+    if b == nil {
+        return 0
+    }
+    return int(binary.BigEndian.Uint16(b))
+}
+
+func (r *binaryReader) uint32() int {
+    b := r.next(4)
+    if b == nil {
+        return 0
+    }
+    return int(binary.BigEndian.Uint32(b))
+}
+
+func (r *binaryReader) int64() int64 {
+    b := r.next(8)
+    if b == nil {
+        return 0
+    }
+    return int64(binary.BigEndian.Uint64(b))
+}
+
+// A copy, so the result doesn't keep the whole file alive.
+func (r *binaryReader) bytes(n int) []byte {
+    b := r.next(n)
+    if b == nil {
+        return []byte{}
+    }
+    return append([]byte{}, b...)
+}
+
+// A count read from the file is not trusted for allocation beyond what
+// the remaining bytes could hold.
+func (r *binaryReader) capacity(n int) int {
+    if rest := len(r.data) - r.pos; n > rest {
+        return rest
+    }
+    return n
+}
@@ -0,0 +1,224 @@
+package compiler
+
+import (
+    "encoding/binary"
+    "hash/crc32"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+func TestBytecodeRoundTrip(t *testing.T) {
+    inputs := []string {
+        "1 + 2",
+        `let s = "monkey"; let n = -9223372036854775807 - 1; [s, "", n]`,
+        `let n = 2; "${n} + ${n} = ${n + n}"`,
+        "if (1 > 2) { 10 } else { {1: 2}[1] }",
+    }
+
+    bytecodes := []*Bytecode{}
+    for _, input := range inputs {
+        comp := New()
+        comp.SetOptions(Options{FoldConstants: true, Peephole: true, Superinstructions: true})
+        err := comp.Compile(parse(input))
+        if err != nil {
+            t.Fatalf("compiler error: %s", err)
+        }
+        bytecodes = append(bytecodes, comp.Bytecode())
+    }
+
+    // handlers, jump tables and a wide operand, which no source produces
+    bytecodes = append(bytecodes, &Bytecode{
+        Instructions: concatInstructions([]code.Instructions{
+            code.Make(code.OpGetGlobal, 70000),
+            code.Make(code.OpJumpTable, 0),
+            code.Make(code.OpThrow),
+            code.Make(code.OpConst, 0),
+        }),
+        Constants: []object.Object{&object.String{Value: "ß\x00"}},
+        Handlers: []Handler{{Start: 0, End: 9, Target: 10, StackDepth: 1}},
+        JumpTables: []JumpTable{{Min: -3, Targets: []int{9, 13}, Default: 0}},
+    })
+
+    for _, bc := range bytecodes {
+        data, err := bc.MarshalBinary()
+        if err != nil {
+            t.Fatalf("marshal error: %s", err)
+        }
+
+        loaded := &Bytecode{}
+        err = loaded.UnmarshalBinary(data)
+        if err != nil {
+            t.Fatalf("unmarshal error: %s", err)
+        }
+        testSameBytecode(t, bc, loaded)
+    }
+}
+
+func TestSaveAndLoad(t *testing.T) {
+    comp := New()
+    err := comp.Compile(parse(`let a = "x"; a + "y"`))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    bc := comp.Bytecode()
+
+    path := filepath.Join(t.TempDir(), "program" + FileExtension)
+    err = bc.Save(path)
+    if err != nil {
+        t.Fatalf("save error: %s", err)
+    }
+    loaded, err := Load(path)
+    if err != nil {
+        t.Fatalf("load error: %s", err)
+    }
+    testSameBytecode(t, bc, loaded)
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+    comp := New()
+    err := comp.Compile(parse(`1 + 2; "three"`))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    data, err := comp.Bytecode().MarshalBinary()
+    if err != nil {
+        t.Fatalf("marshal error: %s", err)
+    }
+
+    modified := func(f func(d []byte) []byte) []byte {
+        return f(append([]byte{}, data...))
+    }
+    // recompute the checksum after a change
+    resealed := func(d []byte) []byte {
+        binary.BigEndian.PutUint32(d[len(d) - 4:], crc32.ChecksumIEEE(d[:len(d) - 4]))
+        return d
+    }
+    // first constant tag: header, fingerprint, instruction length and instructions, count
+    tagPos := 4 + 2 + 2 + 4 + 4 + len(comp.Bytecode().Instructions) + 4
+
+    tests := []struct {
+        data []byte
+        expected string
+    }{
+        {[]byte{}, "not a monkey bytecode file"},
+        {[]byte("let x = 1;"), "not a monkey bytecode file"},
+        {data[:6], "bytecode truncated"},
+        {modified(func(d []byte) []byte { d[5] = 9; return d }), "unsupported bytecode version 9, expected 2"},
+        {modified(func(d []byte) []byte { d[11] ^= 1; return resealed(d) }), "bytecode built for another opcode table"},
+        {modified(func(d []byte) []byte { d[len(d) - 5] ^= 1; return d }), "bytecode checksum mismatch"},
+        {modified(func(d []byte) []byte { d[tagPos] = 9; return resealed(d) }), "unknown constant tag 9"},
+        // the instruction length is past the end
+        {modified(func(d []byte) []byte { d[12] = 0x7f; return resealed(d) }), "bytecode truncated"},
+        {resealed(append(modified(func(d []byte) []byte { return d }), 0)), "unexpected bytes after the jump tables"},
+    }
+
+    for i, test := range tests {
+        err := (&Bytecode{}).UnmarshalBinary(test.data)
+        if err == nil || !strings.Contains(err.Error(), test.expected) {
+            t.Errorf("test %d: expected error %q. got=%v", i, test.expected, err)
+        }
+    }
+
+    bc := &Bytecode{Constants: []object.Object{&object.Boolean{Value: true}}}
+    _, err = bc.MarshalBinary()
+    if err == nil || err.Error() != "cannot serialize constant of type BOOLEAN" {
+        t.Errorf("expected a serialize error. got=%v", err)
+    }
+}
+
+func TestUnmarshalChecksOperands(t *testing.T) {
+    // OpJump 3; OpConst 0; OpJumpTable 0, starting at 0, 3 and 6
+    ins := concatInstructions([]code.Instructions{
+        code.Make(code.OpJump, 3),
+        code.Make(code.OpConst, 0),
+        code.Make(code.OpJumpTable, 0),
+    })
+    constants := []object.Object{&object.Integer{Value: 1}}
+    tables := []JumpTable{{Min: 0, Targets: []int{3}, Default: 9}}
+
+    tests := []struct {
+        bc *Bytecode
+        expected string
+    }{
+        {&Bytecode{Instructions: ins, JumpTables: tables}, "OpConst operand 0 out of range, the limit is 0"},
+        {&Bytecode{Instructions: ins, Constants: constants}, "OpJumpTable operand 0 out of range"},
+        {&Bytecode{Instructions: code.Make(code.OpGetGlobal, MaxGlobals)}, "OpGetGlobal operand"},
+        {&Bytecode{Instructions: code.Make(code.OpJump, 1)}, "OpJump jumps to 1, not an instruction"},
+        {&Bytecode{Instructions: code.Make(code.OpJump, 4)}, "OpJump jumps to 4"},
+        {&Bytecode{Instructions: code.Instructions{byte(code.OpConst), 0}}, "at 0000"},
+        {
+            &Bytecode{Instructions: ins, Constants: constants, JumpTables: tables,
+                Handlers: []Handler{{Start: 3, End: 1, Target: 0}}},
+            "handler 0: bad range 3-1",
+        },
+        {
+            &Bytecode{Instructions: ins, Constants: constants, JumpTables: tables,
+                Handlers: []Handler{{Start: 6, End: 3, Target: 0}}},
+            "handler 0: bad range 6-3",
+        },
+        {
+            &Bytecode{Instructions: ins, Constants: constants, JumpTables: tables,
+                Handlers: []Handler{{Start: 0, End: 9, Target: 10}}},
+            "target 10",
+        },
+        {
+            &Bytecode{Instructions: ins, Constants: constants,
+                JumpTables: []JumpTable{{Min: 0, Targets: []int{4}, Default: 9}}},
+            "jump table 0: target 4 is not an instruction",
+        },
+        {
+            &Bytecode{Instructions: ins, Constants: constants,
+                JumpTables: []JumpTable{{Min: 0, Targets: []int{3}, Default: 99}}},
+            "jump table 0: target 99 is not an instruction",
+        },
+    }
+
+    for i, test := range tests {
+        data, err := test.bc.MarshalBinary()
+        if err != nil {
+            t.Fatalf("test %d: marshal error: %s", i, err)
+        }
+        err = (&Bytecode{}).UnmarshalBinary(data)
+        if err == nil || !strings.Contains(err.Error(), test.expected) {
+            t.Errorf("test %d: expected error %q. got=%v", i, test.expected, err)
+        }
+    }
+
+    // the same with everything in range loads
+    data, err := (&Bytecode{Instructions: ins, Constants: constants, JumpTables: tables}).MarshalBinary()
+    if err != nil {
+        t.Fatalf("marshal error: %s", err)
+    }
+    err = (&Bytecode{}).UnmarshalBinary(data)
+    if err != nil {
+        t.Errorf("unmarshal error: %s", err)
+    }
+}
+
+func testSameBytecode(t *testing.T, expected, actual *Bytecode) {
+    t.Helper()
+
+    if !reflect.DeepEqual([]byte(expected.Instructions), []byte(actual.Instructions)) {
+        t.Errorf("wrong instructions.\nwant=%s\ngot=%s", expected.Instructions, actual.Instructions)
+    }
+
+    if len(expected.Constants) != len(actual.Constants) {
+        t.Fatalf("wrong number of constants. want=%d, got=%d", len(expected.Constants), len(actual.Constants))
+    }
+    for i, c := range expected.Constants {
+        if c.Type() != actual.Constants[i].Type() || c.Inspect() != actual.Constants[i].Inspect() {
+            t.Errorf("wrong constant %d. want=%s, got=%s", i, c.Inspect(), actual.Constants[i].Inspect())
+        }
+    }
+
+    if len(expected.Handlers) + len(actual.Handlers) > 0 && !reflect.DeepEqual(expected.Handlers, actual.Handlers) {
+        t.Errorf("wrong handlers. want=%v, got=%v", expected.Handlers, actual.Handlers)
+    }
+    if len(expected.JumpTables) + len(actual.JumpTables) > 0 && !reflect.DeepEqual(expected.JumpTables, actual.JumpTables) {
+        t.Errorf("wrong jump tables. want=%v, got=%v", expected.JumpTables, actual.JumpTables)
+    }
+}
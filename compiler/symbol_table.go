@@ -34,3 +34,18 @@ func (st *SymbolTable) Resolve(name string) (Symbol, bool) {
     s, ok := st.store[name]
     return s, ok
 }
+
+// Number of globals defined so far, the next Define gets this index.
+func (st *SymbolTable) NumDefinitions() int {
+    return st.numDefs
+}
+
+// Names of the globals by index. A name defined again leaves its old
+// index without one.
+func (st *SymbolTable) Names() []string {
+    names := make([]string, st.numDefs)
+    for name, s := range st.store {
+        names[s.Index] = name
+    }
+    return names
+}
@@ -43,3 +43,21 @@ func TestResolveGlobal(t *testing.T) {
         }
     }
 }
+
+func TestNames(t *testing.T) {
+    global := NewSymbolTable()
+    global.Define("a")
+    global.Define("b")
+    global.Define("a")
+
+    names := global.Names()
+    expected := []string{"", "b", "a"}
+    if len(names) != len(expected) {
+        t.Fatalf("wrong number of names. want=%d, got=%d", len(expected), len(names))
+    }
+    for i, name := range expected {
+        if names[i] != name {
+            t.Errorf("wrong name of global %d. want=%q, got=%q", i, name, names[i])
+        }
+    }
+}
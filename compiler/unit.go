@@ -0,0 +1,205 @@
+package compiler
+
+import (
+    "bytes"
+    "encoding/binary"
+    "fmt"
+    "hash/crc32"
+    "io/ioutil"
+    "sort"
+    "monkey_interpreter/ast"
+)
+
+// Unit is a separately compiled file, see CompileUnit and Link.
+// Its globals are numbered on their own from 0 to NumGlobals - 1. Exports
+// and Imports give the names of some of them, the rest are private, like
+// a global whose name was defined again.
+type Unit struct {
+    Name string
+    // code, constants, handlers and jump tables of the file alone
+    Bytecode *Bytecode
+    // name -> index of the globals the file defines
+    Exports map[string]int
+    // name -> index of the globals the file uses but doesn't define
+    Imports map[string]int
+    NumGlobals int
+}
+
+// Compile a file on its own. A name used before any let in the file
+// defines it is an import, which Link takes from an earlier unit. Every
+// name the file defines is exported, and shadows an earlier unit's.
+func CompileUnit(name string, program *ast.Program, opts Options) (*Unit, error) {
+    c := New()
+    c.SetOptions(opts)
+    c.imports = make(map[string]int)
+
+    err := c.Compile(program)
+    if err != nil {
+        return nil, err
+    }
+
+    exports := make(map[string]int)
+    for global, s := range c.symbolTable.store {
+        if i, ok := c.imports[global]; ok && i == s.Index {
+            continue
+        }
+        exports[global] = s.Index
+    }
+
+    return &Unit{
+        Name: name,
+        Bytecode: c.Bytecode(),
+        Exports: exports,
+        Imports: c.imports,
+        NumGlobals: c.symbolTable.NumDefinitions(),
+    }, nil
+}
+
+// The .mbo unit file format, numbers big endian:
+//
+//     magic        4 bytes  "\x7fMBO"
+//     version      uint16
+//     reserved     uint16   0
+//     name         uint32 length, then the bytes
+//     globals      uint32 NumGlobals
+//     exports      uint32 count, then per name in sorted order the name
+//                  as uint32 length and bytes, and the index as uint32
+//     imports      the same
+//     bytecode     uint32 length, then a whole .mbc file
+//     checksum     uint32 CRC-32 (IEEE) of everything before it
+
+const UnitFileExtension = ".mbo"
+
+const UnitFormatVersion = 1
+
+var unitMagic = []byte("\x7fMBO")
+
+func (u *Unit) MarshalBinary() ([]byte, error) {
+    bc, err := u.Bytecode.MarshalBinary()
+    if err != nil {
+        return nil, err
+    }
+
+    var out bytes.Buffer
+    w := &binaryWriter{out: &out}
+
+    out.Write(unitMagic)
+    w.uint16(UnitFormatVersion)
+    w.uint16(0)
+
+    w.uint32(len(u.Name))
+    out.WriteString(u.Name)
+    w.uint32(u.NumGlobals)
+    for _, names := range []map[string]int{u.Exports, u.Imports} {
+        w.uint32(len(names))
+        for _, name := range sortedNames(names) {
+            w.uint32(len(name))
+            out.WriteString(name)
+            w.uint32(names[name])
+        }
+    }
+
+    w.uint32(len(bc))
+    out.Write(bc)
+
+    if w.err != nil {
+        return nil, w.err
+    }
+
+    w.uint32(int(crc32.ChecksumIEEE(out.Bytes())))
+    return out.Bytes(), nil
+}
+
+func (u *Unit) UnmarshalBinary(data []byte) error {
+    if len(data) < len(unitMagic) || !bytes.Equal(data[:len(unitMagic)], unitMagic) {
+        return fmt.Errorf("not a monkey unit file")
+    }
+    if len(data) < len(unitMagic) + 4 + 4 {
+        return fmt.Errorf("unit truncated")
+    }
+
+    body, sum := data[:len(data) - 4], binary.BigEndian.Uint32(data[len(data) - 4:])
+    r := &binaryReader{data: body, pos: len(unitMagic)}
+
+    version := r.uint16()
+    if version != UnitFormatVersion {
+        return fmt.Errorf("unsupported unit version %d, expected %d", version, UnitFormatVersion)
+    }
+    if crc32.ChecksumIEEE(body) != sum {
+        return fmt.Errorf("unit checksum mismatch")
+    }
+    r.uint16()
+
+    result := Unit{Bytecode: &Bytecode{}}
+    result.Name = string(r.bytes(r.uint32()))
+    result.NumGlobals = r.uint32()
+    result.Exports = r.names()
+    result.Imports = r.names()
+
+    bc := r.bytes(r.uint32())
+    if r.err != nil {
+        return fmt.Errorf("unit truncated")
+    }
+    if r.pos != len(body) {
+        return fmt.Errorf("%d unexpected bytes after the bytecode", len(body) - r.pos)
+    }
+    err := result.Bytecode.UnmarshalBinary(bc)
+    if err != nil {
+        return err
+    }
+
+    for _, names := range []map[string]int{result.Exports, result.Imports} {
+        for name, i := range names {
+            if i >= result.NumGlobals {
+                return fmt.Errorf("global %d of %s out of range", i, name)
+            }
+        }
+    }
+
+    *u = result
+    return nil
+}
+
+// Write the unit to a .mbo file.
+func (u *Unit) Save(path string) error {
+    data, err := u.MarshalBinary()
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(path, data, 0644)
+}
+
+// Read a .mbo file.
+func LoadUnit(path string) (*Unit, error) {
+    data, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+
+    u := &Unit{}
+    err = u.UnmarshalBinary(data)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %s", path, err)
+    }
+    return u, nil
+}
+
+// A name -> index table as MarshalBinary writes it.
+func (r *binaryReader) names() map[string]int {
+    names := make(map[string]int)
+    n := r.uint32()
+    for i := 0; i < n && r.err == nil; i++ {
+        name := string(r.bytes(r.uint32()))
+        names[name] = r.uint32()
+    }
+    return names
+}
+
+func sortedNames(names map[string]int) []string {
+    sorted := []string{}
+    for name := range names {
+        sorted = append(sorted, name)
+    }
+    sort.Strings(sorted)
+    return sorted
+}
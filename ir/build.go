@@ -0,0 +1,357 @@
+package ir
+
+import (
+    "fmt"
+    "sort"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/object"
+    "monkey_compiler/compiler"
+    "monkey_compiler/vm"
+)
+
+// builder turns the ast into SSA form.
+//
+// Every global defined by the program is also an SSA variable: a read
+// uses the value of the reaching definition instead of loading it, with
+// phis where if branches join. The stores are kept, the globals must
+// still hold their values after the program. Globals defined before the
+// program (the previous lines of a REPL) are loaded once at the entry.
+type builder struct {
+    f *Func
+    cur *Block
+    symbolTable *compiler.SymbolTable
+
+    // defs[b][index] is the value of global index at the end of b
+    defs map[*Block]map[int]*Value
+}
+
+// Build the SSA form of a program.
+// Its globals are defined in st, like the stack compiler does.
+func Build(program *ast.Program, st *compiler.SymbolTable) (*Func, error) {
+    f := &Func{}
+    b := &builder{
+        f: f,
+        symbolTable: st,
+        defs: make(map[*Block]map[int]*Value),
+    }
+
+    f.Entry = f.newBlock()
+    b.cur = f.Entry
+
+    for _, s := range program.Statements {
+        err := b.statement(s)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    b.cur.Kind = BlockExit
+    f.NumGlobals = st.NumDefinitions()
+    return f, nil
+}
+
+func (b *builder) statement(node ast.Statement) error {
+    switch node := node.(type) {
+    case *ast.LetStatement:
+        v, err := b.expression(node.Value)
+        if err != nil {
+            return err
+        }
+        symbol := b.symbolTable.Define(node.Name.Value)
+
+        // the copy names the variable, copy propagation removes it
+        v = b.cur.addValue(OpCopy, v)
+        b.writeVariable(b.cur, symbol.Index, v)
+        store := b.cur.addValue(OpSetGlobal, v)
+        store.Aux = symbol.Index
+
+    case *ast.ExpressionStatement:
+        v, err := b.expression(node.Expression)
+        if err != nil {
+            return err
+        }
+        b.cur.addValue(OpResult, v)
+
+    default:
+        return fmt.Errorf("unsupported statement %T", node)
+    }
+
+    return nil
+}
+
+func (b *builder) expression(node ast.Expression) (*Value, error) {
+    switch node := node.(type) {
+    case *ast.IntegerLiteral:
+        return b.constant(&object.Integer{Value: node.Value}), nil
+
+    case *ast.StringLiteral:
+        if compiler.IsTemplate(node.Value) {
+            return b.template(node.Value)
+        }
+        return b.constant(&object.String{Value: node.Value}), nil
+
+    case *ast.Boolean:
+        // the singletons, so comparisons see the same objects as the VM
+        if node.Value {
+            return b.constant(vm.True), nil
+        }
+        return b.constant(vm.False), nil
+
+    case *ast.Identifier:
+        symbol, ok := b.symbolTable.Resolve(node.Value)
+        if !ok {
+            return nil, fmt.Errorf("undefined variable %s", node.Value)
+        }
+        return b.readVariable(b.cur, symbol.Index), nil
+
+    case *ast.PrefixExpression:
+        right, err := b.expression(node.Right)
+        if err != nil {
+            return nil, err
+        }
+
+        switch node.Operator {
+        case "!":
+            return b.cur.addValue(OpBang, right), nil
+        case "-":
+            return b.cur.addValue(OpMinus, right), nil
+        default:
+            return nil, fmt.Errorf("unknown operator")
+        }
+
+    case *ast.InfixExpression:
+        // a < b is b > a, evaluated right to left like the stack compiler
+        left, right := node.Left, node.Right
+        if node.Operator == "<" {
+            left, right = right, left
+        }
+
+        l, err := b.expression(left)
+        if err != nil {
+            return nil, err
+        }
+        r, err := b.expression(right)
+        if err != nil {
+            return nil, err
+        }
+
+        var op Op
+        switch node.Operator {
+        case "+":
+            op = OpAdd
+        case "-":
+            op = OpSub
+        case "*":
+            op = OpMul
+        case "/":
+            op = OpDiv
+        case ">", "<":
+            op = OpGT
+        case "==":
+            op = OpEq
+        case "!=":
+            op = OpNE
+        default:
+            return nil, fmt.Errorf("unknown operator")
+        }
+        return b.cur.addValue(op, l, r), nil
+
+    case *ast.IfExpression:
+        return b.ifExpression(node)
+
+    case *ast.ArrayLiteral:
+        elems := []*Value{}
+        for _, e := range node.Elems {
+            v, err := b.expression(e)
+            if err != nil {
+                return nil, err
+            }
+            elems = append(elems, v)
+        }
+        return b.cur.addValue(OpArray, elems...), nil
+
+    case *ast.HashLiteral:
+        // same key order as the stack compiler
+        keys := []ast.Expression{}
+        for k := range node.Pairs {
+            keys = append(keys, k)
+        }
+        sort.Slice(keys, func(i, j int) bool {
+            return keys[i].String() < keys[j].String()
+        })
+
+        args := []*Value{}
+        for _, k := range keys {
+            key, err := b.expression(k)
+            if err != nil {
+                return nil, err
+            }
+            value, err := b.expression(node.Pairs[k])
+            if err != nil {
+                return nil, err
+            }
+            args = append(args, key, value)
+        }
+        return b.cur.addValue(OpHash, args...), nil
+
+    case *ast.IndexExpression:
+        left, err := b.expression(node.Left)
+        if err != nil {
+            return nil, err
+        }
+        index, err := b.expression(node.Index)
+        if err != nil {
+            return nil, err
+        }
+        return b.cur.addValue(OpIndex, left, index), nil
+
+    default:
+        return nil, fmt.Errorf("unsupported expression %T", node)
+    }
+}
+
+// An if always gets both branches, so no edge goes from a block with two
+// successors to a block with two predecessors and the lowering has a
+// place for the phi moves.
+func (b *builder) ifExpression(node *ast.IfExpression) (*Value, error) {
+    cond, err := b.expression(node.Cond)
+    if err != nil {
+        return nil, err
+    }
+
+    then := b.f.newBlock()
+    alt := b.f.newBlock()
+    b.cur.Kind = BlockIf
+    b.cur.Control = cond
+    addEdge(b.cur, then)
+    addEdge(b.cur, alt)
+
+    b.cur = then
+    thenValue, err := b.block(node.Cons)
+    if err != nil {
+        return nil, err
+    }
+    thenEnd := b.cur
+
+    b.cur = alt
+    var altValue *Value
+    if node.Alt == nil {
+        altValue = b.constant(vm.Null)
+    } else {
+        altValue, err = b.block(node.Alt)
+        if err != nil {
+            return nil, err
+        }
+    }
+    altEnd := b.cur
+
+    join := b.f.newBlock()
+    addEdge(thenEnd, join)
+    addEdge(altEnd, join)
+    b.cur = join
+
+    return b.phi(join, thenValue, altValue), nil
+}
+
+// The value of a block is its last expression statement, or Null.
+func (b *builder) block(block *ast.BlockStatement) (*Value, error) {
+    for i, stmt := range block.Statements {
+        es, ok := stmt.(*ast.ExpressionStatement)
+        if ok && i == len(block.Statements) - 1 {
+            return b.expression(es.Expression)
+        }
+
+        err := b.statement(stmt)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    return b.constant(vm.Null), nil
+}
+
+func (b *builder) template(s string) (*Value, error) {
+    parts, err := compiler.ParseTemplate(s)
+    if err != nil {
+        return nil, err
+    }
+
+    args := []*Value{}
+    for _, part := range parts {
+        if part.Expr == nil {
+            args = append(args, b.constant(&object.String{Value: part.Literal}))
+            continue
+        }
+
+        v, err := b.expression(part.Expr)
+        if err != nil {
+            return nil, err
+        }
+        args = append(args, v)
+    }
+
+    return b.cur.addValue(OpConcat, args...), nil
+}
+
+func (b *builder) constant(obj object.Object) *Value {
+    v := b.cur.addValue(OpConst)
+    v.Const = obj
+    return v
+}
+
+func (b *builder) writeVariable(block *Block, index int, v *Value) {
+    if b.defs[block] == nil {
+        b.defs[block] = make(map[int]*Value)
+    }
+    b.defs[block][index] = v
+}
+
+// The value of a global reaching the end of block.
+// The graph has no loops and every block's predecessors are finished
+// before the block is, so no phi is ever incomplete.
+func (b *builder) readVariable(block *Block, index int) *Value {
+    if v, ok := b.defs[block][index]; ok {
+        return v
+    }
+
+    var v *Value
+    switch len(block.Preds) {
+    case 0:
+        // defined before this program
+        v = b.f.newValue(block, OpGetGlobal)
+        v.Aux = index
+        block.Values = append([]*Value{v}, block.Values...)
+    case 1:
+        v = b.readVariable(block.Preds[0], index)
+    default:
+        args := []*Value{}
+        for _, p := range block.Preds {
+            args = append(args, b.readVariable(p, index))
+        }
+        v = b.phi(block, args...)
+    }
+
+    b.writeVariable(block, index, v)
+    return v
+}
+
+// A phi at the start of block, unless all its arguments are the same.
+func (b *builder) phi(block *Block, args ...*Value) *Value {
+    same := true
+    for _, a := range args {
+        if a != args[0] {
+            same = false
+        }
+    }
+    if same {
+        return args[0]
+    }
+
+    v := b.f.newValue(block, OpPhi, args...)
+    n := 0
+    for n < len(block.Values) && block.Values[n].Op == OpPhi {
+        n++
+    }
+    block.Values = append(block.Values[:n:n], append([]*Value{v}, block.Values[n:]...)...)
+    return v
+}
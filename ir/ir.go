@@ -0,0 +1,222 @@
+package ir
+
+import (
+    "bytes"
+    "fmt"
+    "strings"
+    "monkey_interpreter/object"
+)
+
+type Op int
+
+const (
+    OpConst Op = iota // Const
+    OpGetGlobal       // globals[Aux], only for globals defined before this program
+    OpSetGlobal       // globals[Aux] = Args[0]
+    OpAdd
+    OpSub
+    OpMul
+    OpDiv
+    OpEq
+    OpNE
+    OpGT
+    OpMinus
+    OpBang
+    OpArray  // Args are the elements
+    OpHash   // Args are alternating keys and values
+    OpConcat // Args stringified and joined
+    OpIndex  // Args[0][Args[1]]
+    OpPhi    // Args[i] comes from Block.Preds[i]
+    OpCopy   // Args[0]
+    OpResult // Args[0] becomes the program result, like an expression statement
+)
+
+var opNames = map[Op]string {
+    OpConst: "const",
+    OpGetGlobal: "getglobal",
+    OpSetGlobal: "setglobal",
+    OpAdd: "add",
+    OpSub: "sub",
+    OpMul: "mul",
+    OpDiv: "div",
+    OpEq: "eq",
+    OpNE: "ne",
+    OpGT: "gt",
+    OpMinus: "minus",
+    OpBang: "bang",
+    OpArray: "array",
+    OpHash: "hash",
+    OpConcat: "concat",
+    OpIndex: "index",
+    OpPhi: "phi",
+    OpCopy: "copy",
+    OpResult: "result",
+}
+
+func (op Op) String() string {
+    return opNames[op]
+}
+
+// Values with an effect other than producing a value.
+// They are never removed or merged.
+func (op Op) HasEffect() bool {
+    return op == OpSetGlobal || op == OpResult
+}
+
+type Value struct {
+    ID int
+    Op Op
+    Args []*Value
+    // global index of OpGetGlobal and OpSetGlobal
+    Aux int
+    // value of OpConst
+    Const object.Object
+
+    Block *Block
+}
+
+func (v *Value) String() string {
+    return fmt.Sprintf("v%d", v.ID)
+}
+
+// The instruction that defines v.
+func (v *Value) LongString() string {
+    fields := []string{v.Op.String()}
+
+    switch v.Op {
+    case OpConst:
+        if s, ok := v.Const.(*object.String); ok {
+            fields = append(fields, fmt.Sprintf("%q", s.Value))
+        } else {
+            fields = append(fields, v.Const.Inspect())
+        }
+    case OpGetGlobal, OpSetGlobal:
+        fields = append(fields, fmt.Sprintf("g%d", v.Aux))
+    }
+    for _, arg := range v.Args {
+        fields = append(fields, arg.String())
+    }
+
+    if v.Op.HasEffect() {
+        return strings.Join(fields, " ")
+    }
+    return fmt.Sprintf("%s = %s", v, strings.Join(fields, " "))
+}
+
+type BlockKind int
+
+const (
+    // falls to Succs[0]
+    BlockPlain BlockKind = iota
+    // Succs[0] if Control is truthy, else Succs[1]
+    BlockIf
+    // end of the program
+    BlockExit
+)
+
+type Block struct {
+    ID int
+    Kind BlockKind
+    Values []*Value
+    Control *Value
+
+    Succs []*Block
+    Preds []*Block
+
+    Func *Func
+}
+
+func (b *Block) String() string {
+    return fmt.Sprintf("b%d", b.ID)
+}
+
+// Func is a program in SSA form.
+type Func struct {
+    Blocks []*Block
+    Entry *Block
+
+    // globals defined by the symbol table, the lowering puts its
+    // temporaries after them
+    NumGlobals int
+
+    nextValueID int
+    nextBlockID int
+}
+
+func (f *Func) newBlock() *Block {
+    b := &Block{ID: f.nextBlockID, Func: f}
+    f.nextBlockID++
+    f.Blocks = append(f.Blocks, b)
+    return b
+}
+
+func (f *Func) newValue(b *Block, op Op, args ...*Value) *Value {
+    v := &Value{ID: f.nextValueID, Op: op, Args: args, Block: b}
+    f.nextValueID++
+    return v
+}
+
+func (b *Block) addValue(op Op, args ...*Value) *Value {
+    v := b.Func.newValue(b, op, args...)
+    b.Values = append(b.Values, v)
+    return v
+}
+
+func addEdge(from, to *Block) {
+    from.Succs = append(from.Succs, to)
+    to.Preds = append(to.Preds, from)
+}
+
+// Remove the edge from -> to. Phis in to lose the matching argument.
+func removeEdge(from, to *Block) {
+    for i, s := range from.Succs {
+        if s == to {
+            from.Succs = append(from.Succs[:i:i], from.Succs[i+1:]...)
+            break
+        }
+    }
+
+    for i, p := range to.Preds {
+        if p != from {
+            continue
+        }
+        to.Preds = append(to.Preds[:i:i], to.Preds[i+1:]...)
+        for _, v := range to.Values {
+            if v.Op == OpPhi {
+                v.Args = append(v.Args[:i:i], v.Args[i+1:]...)
+            }
+        }
+        break
+    }
+}
+
+func (f *Func) String() string {
+    var out bytes.Buffer
+
+    for _, b := range f.Blocks {
+        preds := []string{}
+        for _, p := range b.Preds {
+            preds = append(preds, p.String())
+        }
+        if len(preds) == 0 {
+            fmt.Fprintf(&out, "%s:\n", b)
+        } else {
+            fmt.Fprintf(&out, "%s: <- %s\n", b, strings.Join(preds, " "))
+        }
+
+        for _, v := range b.Values {
+            fmt.Fprintf(&out, "    %s\n", v.LongString())
+        }
+
+        switch b.Kind {
+        case BlockPlain:
+            fmt.Fprintf(&out, "    plain -> %s\n", b.Succs[0])
+        case BlockIf:
+            fmt.Fprintf(&out, "    if %s -> %s %s\n", b.Control, b.Succs[0], b.Succs[1])
+        case BlockExit:
+            out.WriteString("    exit\n")
+        }
+    }
+
+    return out.String()
+}
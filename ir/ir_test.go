@@ -0,0 +1,331 @@
+package ir
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/lexer"
+    "monkey_interpreter/parser"
+    "monkey_compiler/code"
+    "monkey_compiler/compiler"
+    "monkey_compiler/vm"
+)
+
+func TestBuild(t *testing.T) {
+    tests := []struct {
+        input string
+        expected string
+    }{
+        {
+            "let x = 1; x + 2",
+            `b0:
+    v0 = const 1
+    v1 = copy v0
+    setglobal g0 v1
+    v3 = const 2
+    v4 = add v1 v3
+    result v4
+    exit
+`,
+        },
+        {
+            // the inner let defines g1, which keeps its old value when
+            // the branch is not taken
+            "let x = 1; if (x > 0) { let x = 2; 3 }; x",
+            `b0:
+    v12 = getglobal g1
+    v0 = const 1
+    v1 = copy v0
+    setglobal g0 v1
+    v3 = const 0
+    v4 = gt v1 v3
+    if v4 -> b1 b2
+b1: <- b0
+    v5 = const 2
+    v6 = copy v5
+    setglobal g1 v6
+    v8 = const 3
+    plain -> b3
+b2: <- b0
+    v9 = const null
+    plain -> b3
+b3: <- b1 b2
+    v10 = phi v8 v9
+    v13 = phi v6 v12
+    result v10
+    result v13
+    exit
+`,
+        },
+    }
+
+    for _, test := range tests {
+        f, err := Build(parse(test.input), compiler.NewSymbolTable())
+        if err != nil {
+            t.Fatalf("build error: %s", err)
+        }
+        if f.String() != test.expected {
+            t.Errorf("wrong ir for %q.\nwant=%s\ngot=%s", test.input, test.expected, f.String())
+        }
+    }
+}
+
+func TestPasses(t *testing.T) {
+    tests := []struct {
+        input string
+        passes []Pass
+        expected string
+    }{
+        {
+            // constant propagation through the variables
+            "let a = 2; let b = a * 3; b - 1",
+            DefaultPasses,
+            `b0:
+    v0 = const 2
+    setglobal g1 v0
+    v4 = const 6
+    setglobal g2 v4
+    v8 = const 5
+    result v8
+    exit
+`,
+        },
+        {
+            // the dead branch goes, the phi becomes a copy
+            "let x = if (1 > 2) { 10 } else { 20 }; x",
+            DefaultPasses,
+            `b0:
+    plain -> b2
+b2: <- b0
+    v4 = const 20
+    plain -> b3
+b3: <- b2
+    setglobal g1 v4
+    result v4
+    exit
+`,
+        },
+        {
+            // common subexpressions, across a dominated block too
+            "[y * 2, y * 2, if (true) { y * 2 }]",
+            []Pass{CSE, CopyProp, DCE},
+            `b0:
+    v0 = getglobal g0
+    v1 = const 2
+    v2 = mul v0 v1
+    v5 = const true
+    if v5 -> b1 b2
+b1: <- b0
+    plain -> b3
+b2: <- b0
+    v8 = const null
+    plain -> b3
+b3: <- b1 b2
+    v9 = phi v2 v8
+    v10 = array v2 v2 v9
+    result v10
+    exit
+`,
+        },
+        {
+            // arrays are compared by identity, two literals stay two
+            "[1] == [1]",
+            DefaultPasses,
+            `b0:
+    v0 = const 1
+    v1 = array v0
+    v3 = array v0
+    v4 = eq v1 v3
+    result v4
+    exit
+`,
+        },
+        {
+            // a division by zero is not folded away
+            "let z = 0; 1 / z",
+            DefaultPasses,
+            `b0:
+    v0 = const 0
+    setglobal g1 v0
+    v3 = const 1
+    v4 = div v3 v0
+    result v4
+    exit
+`,
+        },
+    }
+
+    for _, test := range tests {
+        st := compiler.NewSymbolTable()
+        // a global from an earlier REPL line
+        st.Define("y")
+
+        program := parse(test.input)
+        f, err := Build(program, st)
+        if err != nil {
+            t.Fatalf("build error: %s", err)
+        }
+        NewPassManager(test.passes...).Run(f)
+
+        got := f.String()
+        if got != test.expected {
+            t.Errorf("wrong ir for %q.\nwant=%s\ngot=%s", test.input, test.expected, got)
+        }
+    }
+}
+
+func TestLower(t *testing.T) {
+    tests := []struct {
+        input string
+        expected []code.Instructions
+    }{
+        {
+            "let a = 2; let b = a * 3; b - 1",
+            []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpSetGlobal, 1),
+                code.Make(code.OpConst, 2),
+                code.Make(code.OpPop),
+            },
+        },
+        {
+            // the array is used in three places and the phi comes from
+            // two blocks, both live in temporaries after the global a
+            "let a = [1]; if (a) { a } else { 5 }",
+            []code.Instructions{
+                code.Make(code.OpConst, 0),
+                code.Make(code.OpArray, 1),
+                code.Make(code.OpSetGlobal, 1),
+                code.Make(code.OpGetGlobal, 1),
+                code.Make(code.OpSetGlobal, 0),
+                code.Make(code.OpGetGlobal, 1),
+                code.Make(code.OpJumpNotTruthy, 30),
+                code.Make(code.OpGetGlobal, 1),
+                code.Make(code.OpSetGlobal, 2),
+                code.Make(code.OpJump, 36),
+                code.Make(code.OpConst, 1),
+                code.Make(code.OpSetGlobal, 2),
+                code.Make(code.OpGetGlobal, 2),
+                code.Make(code.OpPop),
+            },
+        },
+    }
+
+    for _, test := range tests {
+        bytecode, err := Compile(parse(test.input), compiler.NewSymbolTable(), NewPassManager())
+        if err != nil {
+            t.Fatalf("ir compile error: %s", err)
+        }
+
+        expected := code.Instructions{}
+        for _, ins := range test.expected {
+            expected = append(expected, ins...)
+        }
+        if bytecode.Instructions.String() != expected.String() {
+            t.Errorf("wrong instructions for %q.\nwant=%s\ngot=%s",
+                test.input, expected, bytecode.Instructions)
+        }
+    }
+}
+
+// Programs compiled through the IR, optimized or not, must behave like
+// the ones from the stack compiler.
+func TestSameResultsAsCompiler(t *testing.T) {
+    inputs := []string {
+        "(5 + 10 * 2 + 15 / 3) * 2 + -10",
+        "1 < 2",
+        "(1 > 2) == false",
+        "!!5",
+        "!(if (false) { 5; })",
+        "if (1 < 2) { 10 } else { 20 }",
+        "if (1 > 2) { 10 }",
+        "if (if (false) { 10 }) { 10 } else { 20 }",
+        "let one = 1; let two = one + one; one + two",
+        `"mon" + "key" + "ship"`,
+        `let n = 2; "${n} + ${n} = ${n + n}"`,
+        "[1 + 2, 3 * 4, 5 + 6]",
+        "{1 + 1: 2 * 2, 3 + 3: 4 * 4}[6]",
+        "[[1, 1, 1]][0][0]",
+        "[1, 2, 3][99]",
+        "let a = 1; if (a) { let b = a + 1; b * 2 } else { 0 }",
+        "let a = [1, 2]; let b = a; a == b",
+        "let a = 3; let b = if (a > 2) { a * 2 } else { a }; [b, b * b, b * b]",
+        "let a = 1; if (a > 0) { let a = 5; a } else { a } + a",
+        "let x = 1; let y = if (x == 1) { if (x > 0) { 10 } else { 20 } } else { 30 }; y + x",
+        "1; 2; 3",
+        "let x = 1;",
+        "1; let x = 2;",
+        "if (true) { 1; 2 }",
+        "let z = if (true) { 7; let y = 2 };",
+        `"a" + "b" == "a" + "b"`,
+        `"${1}" == "${1}"`,
+        `let s = "a"; s + "b" != "ab"`,
+        `let s = "x"; if (s == "x") { s + s } else { s } == "xx"`,
+        "[1] == [1]",
+        "let a = [1]; a == a",
+        `("a" - 1) + (1)[1]; (1)[1];`,
+        `let x = -"a"; let y = (1)[1] + x; (1)[1] + x`,
+        `let x = ("a" - 1) + if (true) { (1)[1] } else { 0 }; (1)[1]`,
+        `[1 / 0, (1)[1]][0] + [1 / 0][0]`,
+    }
+
+    // a branch longer than 65535 bytes needs wide jumps
+    var long strings.Builder
+    long.WriteString("let x = [0][0]; let r = if (x == 0) { x")
+    for i := 1; i <= 20000; i++ {
+        fmt.Fprintf(&long, " + %d", i)
+    }
+    long.WriteString(" } else { 5 }; r")
+    inputs = append(inputs, long.String())
+
+    for _, input := range inputs {
+        comp := compiler.New()
+        err := comp.Compile(parse(input))
+        if err != nil {
+            t.Fatalf("compiler error: %s", err)
+        }
+        expected := run(t, input, comp.Bytecode())
+
+        for _, pm := range []*PassManager{nil, NewPassManager()} {
+            bytecode, err := Compile(parse(input), compiler.NewSymbolTable(), pm)
+            if err != nil {
+                t.Fatalf("ir compile error for %q: %s", input, err)
+            }
+            got := run(t, input, bytecode)
+            if got != expected {
+                t.Errorf("results differ for %q (optimized=%t). want=%s, got=%s",
+                    input, pm != nil, expected, got)
+            }
+        }
+    }
+
+    bytecode, err := Compile(parse("1 / 0"), compiler.NewSymbolTable(), NewPassManager())
+    if err != nil {
+        t.Fatalf("ir compile error: %s", err)
+    }
+    err = vm.New(bytecode).Run()
+    if err == nil || err.Error() != "division by zero" {
+        t.Errorf("expected division by zero. got=%v", err)
+    }
+}
+
+func run(t *testing.T, input string, bytecode *compiler.Bytecode) string {
+    t.Helper()
+
+    machine := vm.New(bytecode)
+    err := machine.Run()
+    if err != nil {
+        // the same error must happen first
+        return "error: " + err.Error()
+    }
+    return machine.Result().Inspect()
+}
+
+func parse(input string) *ast.Program {
+    l := lexer.New(input)
+    p := parser.New(l)
+    return p.ParseProgram()
+}
@@ -0,0 +1,395 @@
+package ir
+
+import (
+    "fmt"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+    "monkey_compiler/compiler"
+)
+
+// Compile a program through the IR: build, optimize with pm (no
+// optimization if nil) and lower it.
+func Compile(program *ast.Program, st *compiler.SymbolTable, pm *PassManager) (*compiler.Bytecode, error) {
+    f, err := Build(program, st)
+    if err != nil {
+        return nil, err
+    }
+    if pm != nil {
+        pm.Run(f)
+    }
+    return Lower(f)
+}
+
+// lowering turns SSA values back into stack code.
+//
+// A value used once, in its own block, is computed where it is used, so
+// expression trees come out as the stack compiler would emit them.
+// Constants and loads of globals are cheap and recomputed at every use.
+// Any other value is computed once into a temporary global after the
+// program's own globals: the VM has no locals. The predecessors of a
+// block with phis store their arguments into the phis' temporaries.
+type lowering struct {
+    f *Func
+    instructions code.Instructions
+    constants []object.Object
+    constantIndex map[compiler.ConstantKey]int
+
+    slots map[*Value]int
+    jumps []jump
+    starts map[*Block]int
+
+    // jumps, by number, that need a wide operand
+    wide map[int]bool
+}
+
+type jump struct {
+    pos int
+    target *Block
+}
+
+// A jump whose target turns out to be past code.MaxOperand is made wide
+// and the code is emitted again, until every jump fits.
+func Lower(f *Func) (*compiler.Bytecode, error) {
+    l := &lowering{
+        f: f,
+        slots: map[*Value]int{},
+        wide: map[int]bool{},
+    }
+
+    l.allocateSlots()
+    if f.NumGlobals + len(l.slots) > compiler.MaxGlobals {
+        return nil, fmt.Errorf("too many globals: the limit is %d", compiler.MaxGlobals)
+    }
+
+    for {
+        l.instructions = code.Instructions{}
+        l.constants = []object.Object{}
+        l.constantIndex = map[compiler.ConstantKey]int{}
+        l.jumps = []jump{}
+        l.starts = map[*Block]int{}
+
+        for i, b := range f.Blocks {
+            var next *Block
+            if i + 1 < len(f.Blocks) {
+                next = f.Blocks[i + 1]
+            }
+            l.block(b, next)
+        }
+        if len(l.instructions) > code.MaxWideOperand {
+            return nil, fmt.Errorf("program too large: the limit is %d bytes of instructions", code.MaxWideOperand)
+        }
+
+        if l.patchJumps() {
+            break
+        }
+    }
+
+    return &compiler.Bytecode{
+        Instructions: l.instructions,
+        Constants: l.constants,
+    }, nil
+}
+
+// Write the jump targets. Report false if some jump needs to become wide.
+// Code only grows from one attempt to the next, so a wide jump never gets
+// a target that would fit a normal one.
+func (l *lowering) patchJumps() bool {
+    fits := true
+
+    for n, j := range l.jumps {
+        op, _, width, _ := code.ReadInstruction(l.instructions[j.pos:])
+        ins := code.Make(op, l.starts[j.target])
+        if len(ins) != width {
+            l.wide[n] = true
+            fits = false
+            continue
+        }
+        copy(l.instructions[j.pos:], ins)
+    }
+
+    return fits
+}
+
+func (l *lowering) allocateSlots() {
+    uses := map[*Value]int{}
+    usedElsewhere := map[*Value]bool{}
+
+    use := func(v *Value, b *Block) {
+        uses[v]++
+        if v.Block != b {
+            usedElsewhere[v] = true
+        }
+    }
+    for _, b := range l.f.Blocks {
+        for _, v := range b.Values {
+            for _, a := range v.Args {
+                if v.Op == OpPhi {
+                    // stored at the end of the predecessor
+                    usedElsewhere[a] = true
+                }
+                use(a, b)
+            }
+        }
+        if b.Control != nil {
+            use(b.Control, b)
+        }
+    }
+
+    for _, b := range l.f.Blocks {
+        for _, v := range b.Values {
+            if v.Op == OpConst || v.Op == OpGetGlobal || v.Op.HasEffect() {
+                continue
+            }
+            if v.Op == OpPhi || uses[v] > 1 || usedElsewhere[v] {
+                l.slots[v] = l.f.NumGlobals + len(l.slots)
+            }
+        }
+    }
+
+    for l.orderErrors() {
+    }
+}
+
+// A value with a slot is computed where it is defined, one without where
+// it is used. So a value that can fail might run after one defined later,
+// and the program would fail with the wrong error. Give such a value a
+// slot too. Report whether any slot was added.
+func (l *lowering) orderErrors() bool {
+    added := false
+
+    for _, b := range l.f.Blocks {
+        // values that can fail, defined but not yet computed
+        pending := []*Value{}
+        computed := map[*Value]bool{}
+
+        // The values computed along with v, like value() does, and whether
+        // one of them can fail.
+        var evaluate func(v *Value) bool
+        evaluate = func(v *Value) bool {
+            if _, ok := l.slots[v]; ok || computed[v] {
+                return false
+            }
+            computed[v] = true
+            fails := canFail(v)
+            for _, a := range v.Args {
+                if evaluate(a) {
+                    fails = true
+                }
+            }
+            return fails
+        }
+
+        flush := func(fails bool) {
+            rest := []*Value{}
+            for _, p := range pending {
+                if computed[p] {
+                    continue
+                }
+                if _, ok := l.slots[p]; ok {
+                    continue
+                }
+                if fails {
+                    l.slots[p] = l.f.NumGlobals + len(l.slots)
+                    added = true
+                    continue
+                }
+                rest = append(rest, p)
+            }
+            pending = rest
+        }
+
+        for _, v := range b.Values {
+            _, hasSlot := l.slots[v]
+            switch {
+            case v.Op == OpSetGlobal || v.Op == OpResult:
+                flush(evaluate(v.Args[0]))
+            case v.Op == OpPhi:
+            case hasSlot:
+                fails := canFail(v)
+                for _, a := range v.Args {
+                    if evaluate(a) {
+                        fails = true
+                    }
+                }
+                flush(fails)
+            case canFail(v):
+                pending = append(pending, v)
+            }
+        }
+
+        for _, s := range b.Succs {
+            i := 0
+            for i < len(s.Preds) && s.Preds[i] != b {
+                i++
+            }
+            for _, v := range s.Values {
+                if v.Op == OpPhi {
+                    flush(evaluate(v.Args[i]))
+                }
+            }
+        }
+        if b.Kind == BlockIf {
+            flush(evaluate(b.Control))
+        }
+    }
+
+    return added
+}
+
+// Whether computing v can fail at run time.
+func canFail(v *Value) bool {
+    op, ok := stackOpcodes[v.Op]
+    switch v.Op {
+    case OpMinus:
+        op, ok = code.OpMinus, true
+    case OpBang:
+        op, ok = code.OpBang, true
+    case OpArray:
+        op, ok = code.OpArray, true
+    case OpHash:
+        op, ok = code.OpHash, true
+    case OpConcat:
+        op, ok = code.OpConcat, true
+    case OpIndex:
+        op, ok = code.OpIndex, true
+    }
+    return ok && code.Has(op, code.Throws)
+}
+
+func (l *lowering) block(b *Block, next *Block) {
+    l.starts[b] = len(l.instructions)
+
+    for _, v := range b.Values {
+        switch {
+        case v.Op == OpSetGlobal:
+            l.value(v.Args[0])
+            l.emit(code.OpSetGlobal, v.Aux)
+        case v.Op == OpResult:
+            l.value(v.Args[0])
+            l.emit(code.OpPop)
+        case v.Op == OpPhi:
+            // stored by the predecessors
+        default:
+            if slot, ok := l.slots[v]; ok {
+                l.compute(v)
+                l.emit(code.OpSetGlobal, slot)
+            }
+        }
+    }
+
+    for _, s := range b.Succs {
+        l.phiMoves(b, s)
+    }
+
+    switch b.Kind {
+    case BlockPlain:
+        if b.Succs[0] != next {
+            l.jump(code.OpJump, b.Succs[0])
+        }
+    case BlockIf:
+        l.value(b.Control)
+        l.jump(code.OpJumpNotTruthy, b.Succs[1])
+        if b.Succs[0] != next {
+            l.jump(code.OpJump, b.Succs[0])
+        }
+    }
+}
+
+// Store the arguments coming from pred into the phis of b.
+func (l *lowering) phiMoves(pred, b *Block) {
+    i := 0
+    for i < len(b.Preds) && b.Preds[i] != pred {
+        i++
+    }
+
+    for _, v := range b.Values {
+        if v.Op != OpPhi {
+            continue
+        }
+        l.value(v.Args[i])
+        l.emit(code.OpSetGlobal, l.slots[v])
+    }
+}
+
+// Push the value of v.
+func (l *lowering) value(v *Value) {
+    if slot, ok := l.slots[v]; ok {
+        l.emit(code.OpGetGlobal, slot)
+        return
+    }
+    l.compute(v)
+}
+
+// Compute v from its arguments and push it.
+func (l *lowering) compute(v *Value) {
+    for _, a := range v.Args {
+        l.value(a)
+    }
+
+    switch v.Op {
+    case OpConst:
+        l.constant(v.Const)
+    case OpGetGlobal:
+        l.emit(code.OpGetGlobal, v.Aux)
+    case OpAdd, OpSub, OpMul, OpDiv, OpEq, OpNE, OpGT:
+        l.emit(stackOpcodes[v.Op])
+    case OpMinus:
+        l.emit(code.OpMinus)
+    case OpBang:
+        l.emit(code.OpBang)
+    case OpArray:
+        l.emit(code.OpArray, len(v.Args))
+    case OpHash:
+        l.emit(code.OpHash, len(v.Args))
+    case OpConcat:
+        l.emit(code.OpConcat, len(v.Args))
+    case OpIndex:
+        l.emit(code.OpIndex)
+    case OpCopy:
+        // the argument is already pushed
+    }
+}
+
+func (l *lowering) constant(obj object.Object) {
+    switch obj := obj.(type) {
+    case *object.Boolean:
+        if obj.Value {
+            l.emit(code.OpTrue)
+        } else {
+            l.emit(code.OpFalse)
+        }
+        return
+    case *object.Null:
+        l.emit(code.OpNull)
+        return
+    }
+
+    // interned like the compiler does
+    key, ok := compiler.KeyOfConstant(obj)
+    if ok {
+        if i, exists := l.constantIndex[key]; exists {
+            l.emit(code.OpConst, i)
+            return
+        }
+        l.constantIndex[key] = len(l.constants)
+    }
+    l.constants = append(l.constants, obj)
+    l.emit(code.OpConst, len(l.constants) - 1)
+}
+
+func (l *lowering) emit(op code.Opcode, operands ...int) int {
+    pos := len(l.instructions)
+    l.instructions = append(l.instructions, code.Make(op, operands...)...)
+    return pos
+}
+
+func (l *lowering) jump(op code.Opcode, target *Block) {
+    n := len(l.jumps)
+    placeholder := 9999
+    if l.wide[n] {
+        placeholder = code.MaxOperand + 1
+    }
+    pos := l.emit(op, placeholder)
+    l.jumps = append(l.jumps, jump{pos: pos, target: target})
+}
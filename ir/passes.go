@@ -0,0 +1,429 @@
+package ir
+
+import (
+    "fmt"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+    "monkey_compiler/vm"
+)
+
+// Pass transforms a Func in place and reports whether it changed anything.
+type Pass struct {
+    Name string
+    Run func(f *Func) bool
+}
+
+var (
+    ConstProp = Pass{"constprop", constProp}
+    CopyProp = Pass{"copyprop", copyProp}
+    CSE = Pass{"cse", cse}
+    DCE = Pass{"dce", dce}
+)
+
+// The passes of NewPassManager without arguments.
+var DefaultPasses = []Pass{ConstProp, CopyProp, CSE, CopyProp, DCE}
+
+// Rounds after which the pass manager gives up on a fixed point.
+const maxRounds = 10
+
+// PassManager runs its passes in order, again and again until none of them
+// changes the Func. One pass often makes work for another: a folded branch
+// turns a phi into a copy, which makes two values equal for CSE.
+type PassManager struct {
+    passes []Pass
+
+    // called after every pass that changed the Func
+    Trace func(pass string, f *Func)
+}
+
+func NewPassManager(passes ...Pass) *PassManager {
+    if len(passes) == 0 {
+        passes = DefaultPasses
+    }
+    return &PassManager{passes: passes}
+}
+
+func (pm *PassManager) Run(f *Func) {
+    for round := 0; round < maxRounds; round++ {
+        changed := false
+
+        for _, p := range pm.passes {
+            if !p.Run(f) {
+                continue
+            }
+            changed = true
+            if pm.Trace != nil {
+                pm.Trace(p.Name, f)
+            }
+        }
+
+        if !changed {
+            return
+        }
+    }
+}
+
+// The stack opcodes naming the shared operations of package vm.
+var stackOpcodes = map[Op]code.Opcode {
+    OpAdd: code.OpAdd,
+    OpSub: code.OpSub,
+    OpMul: code.OpMul,
+    OpDiv: code.OpDiv,
+    OpEq: code.OpEq,
+    OpNE: code.OpNE,
+    OpGT: code.OpGT,
+}
+
+// Fold values whose arguments are constants, and branches on constants.
+// An operation failing at run time, like a division by zero, is left
+// alone so the error still happens.
+func constProp(f *Func) bool {
+    changed := false
+
+    for _, b := range f.Blocks {
+        for _, v := range b.Values {
+            result, ok := fold(v)
+            if !ok {
+                continue
+            }
+            v.Op = OpConst
+            v.Const = result
+            v.Args = nil
+            changed = true
+        }
+    }
+
+    for _, b := range f.Blocks {
+        if b.Kind != BlockIf || b.Control.Op != OpConst {
+            continue
+        }
+
+        dead := b.Succs[1]
+        if !vm.IsTruthy(b.Control.Const) {
+            dead = b.Succs[0]
+        }
+        removeEdge(b, dead)
+        b.Kind = BlockPlain
+        b.Control = nil
+        changed = true
+    }
+
+    if changed {
+        removeUnreachable(f)
+    }
+    return changed
+}
+
+func fold(v *Value) (object.Object, bool) {
+    args := []object.Object{}
+    for _, a := range v.Args {
+        if a.Op != OpConst {
+            return nil, false
+        }
+        args = append(args, a.Const)
+    }
+
+    switch v.Op {
+    case OpAdd, OpSub, OpMul, OpDiv:
+        result, err := vm.BinaryOperation(stackOpcodes[v.Op], args[0], args[1])
+        return result, err == nil
+
+    case OpEq, OpNE, OpGT:
+        // arrays and hashes compare by identity in the VM
+        if !sameScalarType(args[0], args[1]) {
+            return nil, false
+        }
+        result, err := vm.Comparison(stackOpcodes[v.Op], args[0], args[1])
+        return result, err == nil
+
+    case OpMinus:
+        result, err := vm.Minus(args[0])
+        return result, err == nil
+
+    case OpBang:
+        return vm.Bang(args[0]), true
+
+    case OpConcat:
+        return vm.Concat(args), true
+    }
+
+    return nil, false
+}
+
+func sameScalarType(l, r object.Object) bool {
+    switch l.(type) {
+    case *object.Integer:
+        _, ok := r.(*object.Integer)
+        return ok
+    case *object.String:
+        _, ok := r.(*object.String)
+        return ok
+    case *object.Boolean:
+        _, ok := r.(*object.Boolean)
+        return ok
+    }
+    return false
+}
+
+// Drop the blocks no longer reachable from the entry.
+func removeUnreachable(f *Func) {
+    reachable := map[*Block]bool{}
+    var visit func(b *Block)
+    visit = func(b *Block) {
+        if reachable[b] {
+            return
+        }
+        reachable[b] = true
+        for _, s := range b.Succs {
+            visit(s)
+        }
+    }
+    visit(f.Entry)
+
+    live := []*Block{}
+    for _, b := range f.Blocks {
+        if reachable[b] {
+            live = append(live, b)
+            continue
+        }
+        for len(b.Succs) > 0 {
+            removeEdge(b, b.Succs[0])
+        }
+    }
+    f.Blocks = live
+}
+
+// Replace every use of a copy by the copied value. A phi whose arguments
+// are all the same value becomes a copy of it.
+func copyProp(f *Func) bool {
+    changed := false
+
+    for _, b := range f.Blocks {
+        for _, v := range b.Values {
+            if v.Op == OpPhi && len(v.Args) > 0 && allSame(v.Args) {
+                v.Op = OpCopy
+                v.Args = v.Args[:1]
+                changed = true
+            }
+        }
+    }
+
+    for _, b := range f.Blocks {
+        for _, v := range b.Values {
+            for i, a := range v.Args {
+                if a.Op == OpCopy {
+                    v.Args[i] = copySource(a)
+                    changed = true
+                }
+            }
+        }
+        if b.Control != nil && b.Control.Op == OpCopy {
+            b.Control = copySource(b.Control)
+            changed = true
+        }
+    }
+
+    return changed
+}
+
+func allSame(values []*Value) bool {
+    for _, v := range values {
+        if v != values[0] {
+            return false
+        }
+    }
+    return true
+}
+
+func copySource(v *Value) *Value {
+    for v.Op == OpCopy {
+        v = v.Args[0]
+    }
+    return v
+}
+
+// Common-subexpression elimination. A value equal to one in a dominating
+// block, or earlier in the same block, becomes a copy of it.
+//
+// Only values compared by value in the VM are merged: integers, strings
+// and booleans. Two array or hash literals are different objects and ==
+// tells them apart.
+func cse(f *Func) bool {
+    idom := dominators(f)
+    children := map[*Block][]*Block{}
+    for _, b := range f.Blocks {
+        if b != f.Entry {
+            children[idom[b]] = append(children[idom[b]], b)
+        }
+    }
+
+    changed := false
+    available := map[string]*Value{}
+
+    var walk func(b *Block)
+    walk = func(b *Block) {
+        added := []string{}
+
+        for _, v := range b.Values {
+            if !mergeable(v) {
+                continue
+            }
+            key := valueKey(v)
+            if w, ok := available[key]; ok {
+                v.Op = OpCopy
+                v.Args = []*Value{w}
+                v.Const = nil
+                changed = true
+                continue
+            }
+            available[key] = v
+            added = append(added, key)
+        }
+
+        for _, c := range children[b] {
+            walk(c)
+        }
+
+        for _, key := range added {
+            delete(available, key)
+        }
+    }
+    walk(f.Entry)
+
+    return changed
+}
+
+func mergeable(v *Value) bool {
+    switch v.Op {
+    case OpConst, OpGetGlobal, OpAdd, OpSub, OpMul, OpDiv, OpMinus,
+        OpEq, OpNE, OpGT, OpBang, OpIndex, OpConcat:
+        // globals are never stored to after being loaded: a let always
+        // defines a new one
+        return true
+    }
+    return false
+}
+
+func valueKey(v *Value) string {
+    key := fmt.Sprintf("%s %d", v.Op, v.Aux)
+    if v.Op == OpConst {
+        key += fmt.Sprintf(" %s %s", v.Const.Type(), v.Const.Inspect())
+    }
+    for _, a := range v.Args {
+        key += " " + a.String()
+    }
+    return key
+}
+
+// The immediate dominator of every block but the entry, by the iterative
+// algorithm of Cooper, Harvey and Kennedy.
+func dominators(f *Func) map[*Block]*Block {
+    order := postorder(f)
+    number := map[*Block]int{}
+    for i, b := range order {
+        number[b] = i
+    }
+
+    idom := map[*Block]*Block{f.Entry: f.Entry}
+    intersect := func(a, b *Block) *Block {
+        for a != b {
+            for number[a] < number[b] {
+                a = idom[a]
+            }
+            for number[b] < number[a] {
+                b = idom[b]
+            }
+        }
+        return a
+    }
+
+    for changed := true; changed; {
+        changed = false
+        // reverse postorder
+        for i := len(order) - 1; i >= 0; i-- {
+            b := order[i]
+            if b == f.Entry {
+                continue
+            }
+
+            var d *Block
+            for _, p := range b.Preds {
+                if idom[p] == nil {
+                    continue
+                }
+                if d == nil {
+                    d = p
+                } else {
+                    d = intersect(p, d)
+                }
+            }
+            if idom[b] != d {
+                idom[b] = d
+                changed = true
+            }
+        }
+    }
+
+    return idom
+}
+
+func postorder(f *Func) []*Block {
+    order := []*Block{}
+    seen := map[*Block]bool{}
+
+    var visit func(b *Block)
+    visit = func(b *Block) {
+        seen[b] = true
+        for _, s := range b.Succs {
+            if !seen[s] {
+                visit(s)
+            }
+        }
+        order = append(order, b)
+    }
+    visit(f.Entry)
+
+    return order
+}
+
+// Dead-code elimination: values without uses and without effects.
+func dce(f *Func) bool {
+    changed := false
+
+    for {
+        uses := useCounts(f)
+        removed := false
+
+        for _, b := range f.Blocks {
+            live := b.Values[:0]
+            for _, v := range b.Values {
+                if uses[v] == 0 && !v.Op.HasEffect() {
+                    removed = true
+                    continue
+                }
+                live = append(live, v)
+            }
+            b.Values = live
+        }
+
+        if !removed {
+            return changed
+        }
+        changed = true
+    }
+}
+
+func useCounts(f *Func) map[*Value]int {
+    uses := map[*Value]int{}
+    for _, b := range f.Blocks {
+        for _, v := range b.Values {
+            for _, a := range v.Args {
+                uses[a]++
+            }
+        }
+        if b.Control != nil {
+            uses[b.Control]++
+        }
+    }
+    return uses
+}
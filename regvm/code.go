@@ -0,0 +1,118 @@
+package regvm
+
+import (
+    "bytes"
+    "fmt"
+    "monkey_interpreter/object"
+)
+
+type Opcode byte
+
+// Three-address instructions. A is the destination register unless noted.
+const (
+    OpLoadConst Opcode = iota // A = constants[B]
+    OpLoadTrue                // A = true
+    OpLoadFalse               // A = false
+    OpLoadNull                // A = null
+    OpGetGlobal               // A = globals[B]
+    OpSetGlobal               // globals[A] = B
+    OpMove                    // A = B
+    OpAdd                     // A = B + C
+    OpSub                     // A = B - C
+    OpMul                     // A = B * C
+    OpDiv                     // A = B / C
+    OpEq                      // A = B == C
+    OpNE                      // A = B != C
+    OpGT                      // A = B > C
+    OpMinus                   // A = -B
+    OpBang                    // A = !B
+    OpJump                    // jump to A
+    OpJumpNotTruthy           // jump to A unless B is truthy
+    OpArray                   // A = [B, B+1, ..., B+C-1]
+    OpHash                    // A = {B: B+1, ..., B+C-2: B+C-1}
+    OpConcat                  // A = B ... B+C-1 stringified and joined
+    OpIndex                   // A = B[C]
+    OpResult                  // the program result is A
+)
+
+var opcodeNames = map[Opcode]string {
+    OpLoadConst: "LoadConst",
+    OpLoadTrue: "LoadTrue",
+    OpLoadFalse: "LoadFalse",
+    OpLoadNull: "LoadNull",
+    OpGetGlobal: "GetGlobal",
+    OpSetGlobal: "SetGlobal",
+    OpMove: "Move",
+    OpAdd: "Add",
+    OpSub: "Sub",
+    OpMul: "Mul",
+    OpDiv: "Div",
+    OpEq: "Eq",
+    OpNE: "NE",
+    OpGT: "GT",
+    OpMinus: "Minus",
+    OpBang: "Bang",
+    OpJump: "Jump",
+    OpJumpNotTruthy: "JumpNotTruthy",
+    OpArray: "Array",
+    OpHash: "Hash",
+    OpConcat: "Concat",
+    OpIndex: "Index",
+    OpResult: "Result",
+}
+
+func (op Opcode) String() string {
+    name, ok := opcodeNames[op]
+    if !ok {
+        return fmt.Sprintf("Op(%d)", byte(op))
+    }
+    return name
+}
+
+type Instruction struct {
+    Op Opcode
+    A int
+    B int
+    C int
+}
+
+func (ins Instruction) String() string {
+    switch ins.Op {
+    case OpLoadTrue, OpLoadFalse, OpLoadNull, OpResult:
+        return fmt.Sprintf("%s r%d", ins.Op, ins.A)
+    case OpLoadConst:
+        return fmt.Sprintf("%s r%d k%d", ins.Op, ins.A, ins.B)
+    case OpGetGlobal:
+        return fmt.Sprintf("%s r%d g%d", ins.Op, ins.A, ins.B)
+    case OpSetGlobal:
+        return fmt.Sprintf("%s g%d r%d", ins.Op, ins.A, ins.B)
+    case OpMove, OpMinus, OpBang:
+        return fmt.Sprintf("%s r%d r%d", ins.Op, ins.A, ins.B)
+    case OpJump:
+        return fmt.Sprintf("%s %04d", ins.Op, ins.A)
+    case OpJumpNotTruthy:
+        return fmt.Sprintf("%s %04d r%d", ins.Op, ins.A, ins.B)
+    case OpArray, OpHash, OpConcat:
+        return fmt.Sprintf("%s r%d r%d %d", ins.Op, ins.A, ins.B, ins.C)
+    default:
+        return fmt.Sprintf("%s r%d r%d r%d", ins.Op, ins.A, ins.B, ins.C)
+    }
+}
+
+// Program is the output of the register compiler.
+type Program struct {
+    Instructions []Instruction
+    Constants []object.Object
+    NumRegisters int
+    NumGlobals int
+}
+
+func (p *Program) String() string {
+    var out bytes.Buffer
+
+    for i, ins := range p.Instructions {
+        fmt.Fprintf(&out, "%04d %s\n", i, ins)
+    }
+
+    return out.String()
+}
@@ -0,0 +1,335 @@
+package regvm
+
+import (
+    "fmt"
+    "sort"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/object"
+    "monkey_compiler/compiler"
+)
+
+// Compiler translates the ast into three-address instructions.
+//
+// Registers are allocated like a stack: an expression's value goes into
+// the first free register and its temporaries above it are released
+// when it is done. So the elements of an array literal end up in
+// consecutive registers without any moves.
+type Compiler struct {
+    instructions []Instruction
+    constants []object.Object
+    constantIndex map[compiler.ConstantKey]int
+
+    symbolTable *compiler.SymbolTable
+
+    // first free register
+    next int
+    numRegisters int
+}
+
+func NewCompiler() *Compiler {
+    return &Compiler{
+        instructions: []Instruction{},
+        constants: []object.Object{},
+        constantIndex: make(map[compiler.ConstantKey]int),
+        symbolTable: compiler.NewSymbolTable(),
+    }
+}
+
+func (c *Compiler) Program() *Program {
+    return &Program{
+        Instructions: c.instructions,
+        Constants: c.constants,
+        NumRegisters: c.numRegisters,
+        NumGlobals: c.symbolTable.NumDefinitions(),
+    }
+}
+
+func (c *Compiler) Compile(node ast.Node) error {
+    program, ok := node.(*ast.Program)
+    if !ok {
+        return fmt.Errorf("expected *ast.Program, got %T", node)
+    }
+
+    for _, s := range program.Statements {
+        c.next = 0
+        r, err := c.compileStatement(s)
+        if err != nil {
+            return err
+        }
+        // the last top-level statement's value is the result, as in the
+        // stack VM
+        c.emit(OpResult, r, 0, 0)
+    }
+
+    return nil
+}
+
+// Compile a statement and return the register holding its value: the
+// expression's, or the one a let binds. The register is free again.
+func (c *Compiler) compileStatement(node ast.Statement) (int, error) {
+    switch node := node.(type) {
+    case *ast.LetStatement:
+        r, err := c.compileExpression(node.Value)
+        if err != nil {
+            return 0, err
+        }
+        symbol := c.symbolTable.Define(node.Name.Value)
+        if symbol.Index >= compiler.MaxGlobals {
+            return 0, fmt.Errorf("too many globals: the limit is %d", compiler.MaxGlobals)
+        }
+        c.emit(OpSetGlobal, symbol.Index, r, 0)
+        c.next = r
+        return r, nil
+
+    case *ast.ExpressionStatement:
+        r, err := c.compileExpression(node.Expression)
+        if err != nil {
+            return 0, err
+        }
+        c.next = r
+        return r, nil
+
+    default:
+        return 0, fmt.Errorf("unsupported statement %T", node)
+    }
+}
+
+// Compile an expression into the first free register and return it.
+// On return exactly that register is allocated.
+func (c *Compiler) compileExpression(node ast.Expression) (int, error) {
+    dst := c.next
+
+    switch node := node.(type) {
+    case *ast.IntegerLiteral:
+        c.alloc()
+        c.emit(OpLoadConst, dst, c.addConstant(&object.Integer{Value: node.Value}), 0)
+
+    case *ast.StringLiteral:
+        if compiler.IsTemplate(node.Value) {
+            return c.compileTemplate(node.Value)
+        }
+        c.alloc()
+        c.emit(OpLoadConst, dst, c.addConstant(&object.String{Value: node.Value}), 0)
+
+    case *ast.Boolean:
+        c.alloc()
+        if node.Value {
+            c.emit(OpLoadTrue, dst, 0, 0)
+        } else {
+            c.emit(OpLoadFalse, dst, 0, 0)
+        }
+
+    case *ast.Identifier:
+        symbol, ok := c.symbolTable.Resolve(node.Value)
+        if !ok {
+            return 0, fmt.Errorf("undefined variable %s", node.Value)
+        }
+        c.alloc()
+        c.emit(OpGetGlobal, dst, symbol.Index, 0)
+
+    case *ast.PrefixExpression:
+        r, err := c.compileExpression(node.Right)
+        if err != nil {
+            return 0, err
+        }
+
+        switch node.Operator {
+        case "!":
+            c.emit(OpBang, dst, r, 0)
+        case "-":
+            c.emit(OpMinus, dst, r, 0)
+        default:
+            return 0, fmt.Errorf("unknown operator")
+        }
+
+    case *ast.InfixExpression:
+        // a < b is b > a, evaluated right to left like the stack compiler
+        left, right := node.Left, node.Right
+        if node.Operator == "<" {
+            left, right = right, left
+        }
+
+        l, err := c.compileExpression(left)
+        if err != nil {
+            return 0, err
+        }
+        r, err := c.compileExpression(right)
+        if err != nil {
+            return 0, err
+        }
+
+        var op Opcode
+        switch node.Operator {
+        case "+":
+            op = OpAdd
+        case "-":
+            op = OpSub
+        case "*":
+            op = OpMul
+        case "/":
+            op = OpDiv
+        case ">", "<":
+            op = OpGT
+        case "==":
+            op = OpEq
+        case "!=":
+            op = OpNE
+        default:
+            return 0, fmt.Errorf("unknown operator")
+        }
+        c.emit(op, dst, l, r)
+
+    case *ast.IfExpression:
+        c.alloc()
+
+        cond, err := c.compileExpression(node.Cond)
+        if err != nil {
+            return 0, err
+        }
+        jumpNotTruthyPos := c.emit(OpJumpNotTruthy, 9999, cond, 0)
+        c.next = dst + 1
+
+        err = c.compileBlock(node.Cons, dst)
+        if err != nil {
+            return 0, err
+        }
+        jumpPos := c.emit(OpJump, 9999, 0, 0)
+
+        c.instructions[jumpNotTruthyPos].A = len(c.instructions)
+        if node.Alt == nil {
+            c.emit(OpLoadNull, dst, 0, 0)
+        } else {
+            err = c.compileBlock(node.Alt, dst)
+            if err != nil {
+                return 0, err
+            }
+        }
+        c.instructions[jumpPos].A = len(c.instructions)
+
+    case *ast.ArrayLiteral:
+        for _, elem := range node.Elems {
+            _, err := c.compileExpression(elem)
+            if err != nil {
+                return 0, err
+            }
+        }
+        c.emit(OpArray, dst, dst, len(node.Elems))
+
+    case *ast.HashLiteral:
+        // same key order as the stack compiler
+        keys := []ast.Expression{}
+        for k := range node.Pairs {
+            keys = append(keys, k)
+        }
+        sort.Slice(keys, func(i, j int) bool {
+            return keys[i].String() < keys[j].String()
+        })
+
+        for _, k := range keys {
+            _, err := c.compileExpression(k)
+            if err != nil {
+                return 0, err
+            }
+            _, err = c.compileExpression(node.Pairs[k])
+            if err != nil {
+                return 0, err
+            }
+        }
+        c.emit(OpHash, dst, dst, len(node.Pairs) * 2)
+
+    case *ast.IndexExpression:
+        l, err := c.compileExpression(node.Left)
+        if err != nil {
+            return 0, err
+        }
+        i, err := c.compileExpression(node.Index)
+        if err != nil {
+            return 0, err
+        }
+        c.emit(OpIndex, dst, l, i)
+
+    default:
+        return 0, fmt.Errorf("unsupported expression %T", node)
+    }
+
+    c.next = dst + 1
+    return dst, nil
+}
+
+// The value of a block is its last expression statement, or Null.
+func (c *Compiler) compileBlock(block *ast.BlockStatement, dst int) error {
+    for i, stmt := range block.Statements {
+        es, ok := stmt.(*ast.ExpressionStatement)
+        if ok && i == len(block.Statements) - 1 {
+            r, err := c.compileExpression(es.Expression)
+            if err != nil {
+                return err
+            }
+            c.emit(OpMove, dst, r, 0)
+            c.next = dst + 1
+            return nil
+        }
+
+        _, err := c.compileStatement(stmt)
+        if err != nil {
+            return err
+        }
+    }
+
+    c.emit(OpLoadNull, dst, 0, 0)
+    return nil
+}
+
+func (c *Compiler) compileTemplate(s string) (int, error) {
+    dst := c.next
+
+    parts, err := compiler.ParseTemplate(s)
+    if err != nil {
+        return 0, err
+    }
+
+    for _, part := range parts {
+        if part.Expr == nil {
+            r := c.alloc()
+            c.emit(OpLoadConst, r, c.addConstant(&object.String{Value: part.Literal}), 0)
+            continue
+        }
+
+        _, err := c.compileExpression(part.Expr)
+        if err != nil {
+            return 0, err
+        }
+    }
+
+    c.emit(OpConcat, dst, dst, len(parts))
+    c.next = dst + 1
+    return dst, nil
+}
+
+func (c *Compiler) alloc() int {
+    r := c.next
+    c.next++
+    if c.next > c.numRegisters {
+        c.numRegisters = c.next
+    }
+    return r
+}
+
+func (c *Compiler) emit(op Opcode, a, b, cc int) int {
+    c.instructions = append(c.instructions, Instruction{Op: op, A: a, B: b, C: cc})
+    return len(c.instructions) - 1
+}
+
+// Integers and strings are interned like in the stack compiler.
+func (c *Compiler) addConstant(obj object.Object) int {
+    key, ok := compiler.KeyOfConstant(obj)
+    if ok {
+        if i, exists := c.constantIndex[key]; exists {
+            return i
+        }
+        c.constantIndex[key] = len(c.constants)
+    }
+
+    c.constants = append(c.constants, obj)
+    return len(c.constants) - 1
+}
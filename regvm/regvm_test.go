@@ -0,0 +1,262 @@
+package regvm
+
+import (
+    "fmt"
+    "strings"
+    "testing"
+    "monkey_interpreter/ast"
+    "monkey_interpreter/lexer"
+    "monkey_interpreter/object"
+    "monkey_interpreter/parser"
+    "monkey_compiler/compiler"
+    "monkey_compiler/vm"
+)
+
+func TestCompiler(t *testing.T) {
+    tests := []struct {
+        input string
+        expected string
+    }{
+        {
+            "1 + 2 * 3",
+            `0000 LoadConst r0 k0
+0001 LoadConst r1 k1
+0002 LoadConst r2 k2
+0003 Mul r1 r1 r2
+0004 Add r0 r0 r1
+0005 Result r0
+`,
+        },
+        {
+            "let x = 1; [x, x < 2]",
+            `0000 LoadConst r0 k0
+0001 SetGlobal g0 r0
+0002 Result r0
+0003 GetGlobal r0 g0
+0004 LoadConst r1 k1
+0005 GetGlobal r2 g0
+0006 GT r1 r1 r2
+0007 Array r0 r0 2
+0008 Result r0
+`,
+        },
+        {
+            "if (true) { 10 } else { 20 }",
+            `0000 LoadTrue r1
+0001 JumpNotTruthy 0005 r1
+0002 LoadConst r1 k0
+0003 Move r0 r1
+0004 Jump 0007
+0005 LoadConst r1 k1
+0006 Move r0 r1
+0007 Result r0
+`,
+        },
+    }
+
+    for _, test := range tests {
+        c := NewCompiler()
+        err := c.Compile(parse(test.input))
+        if err != nil {
+            t.Fatalf("compiler error: %s", err)
+        }
+
+        p := c.Program()
+        if p.String() != test.expected {
+            t.Errorf("wrong instructions for %q.\nwant=%s\ngot=%s", test.input, test.expected, p.String())
+        }
+    }
+}
+
+// The pool is interned with compiler.KeyOfConstant, like the other
+// backends.
+func TestConstantPool(t *testing.T) {
+    c := NewCompiler()
+    err := c.Compile(parse(`1; "1"; 1; "1"; "${1}"`))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+
+    constants := c.Program().Constants
+    if len(constants) != 2 {
+        t.Fatalf("wrong number of constants. want=2, got=%d", len(constants))
+    }
+    if constants[0].Type() != object.INTEGER_OBJ || constants[1].Type() != object.STRING_OBJ {
+        t.Errorf("wrong constants. got=%s, %s", constants[0].Inspect(), constants[1].Inspect())
+    }
+}
+
+// Both engines must agree on every program.
+func TestSameResultsAsStackVM(t *testing.T) {
+    inputs := []string {
+        "(5 + 10 * 2 + 15 / 3) * 2 + -10",
+        "1 < 2",
+        "(1 > 2) == false",
+        "!!5",
+        "!(if (false) { 5; })",
+        "if (1 < 2) { 10 } else { 20 }",
+        "if (1 > 2) { 10 }",
+        "if (if (false) { 10 }) { 10 } else { 20 }",
+        "let one = 1; let two = one + one; one + two",
+        `"mon" + "key" + "ship"`,
+        `let n = 2; "${n} + ${n} = ${n + n}"`,
+        `let n = 2; "\${n} = ${n}"`,
+        "[1 + 2, 3 * 4, 5 + 6]",
+        "{1 + 1: 2 * 2, 3 + 3: 4 * 4}[6]",
+        "[[1, 1, 1]][0][0]",
+        "[1, 2, 3][99]",
+        "let a = 1; if (a) { let b = a + 1; b * 2 } else { 0 }",
+        "1; 2; 3",
+        "let x = 1;",
+        "1; let x = 2;",
+        "if (true) { 1; 2 }",
+        "let z = if (true) { 7; let y = 2 };",
+        "",
+    }
+
+    // globals past 65535
+    var many strings.Builder
+    for i := 0; i < 70000; i++ {
+        fmt.Fprintf(&many, "let g%d = %d; ", i, i)
+    }
+    many.WriteString("g65536 + g69999")
+    inputs = append(inputs, many.String())
+
+    for _, input := range inputs {
+        stack, err := runEngine(stackEngine(t, input))
+        if err != nil {
+            t.Fatalf("stack vm error for %q: %s", input, err)
+        }
+        register, err := runEngine(registerEngine(t, input))
+        if err != nil {
+            t.Fatalf("register vm error for %q: %s", input, err)
+        }
+
+        if inspect(stack) != inspect(register) {
+            t.Errorf("results differ for %q. stack=%s, register=%s", input, inspect(stack), inspect(register))
+        }
+    }
+
+    _, err := runEngine(registerEngine(t, "1 / 0"))
+    if err == nil || err.Error() != "division by zero" {
+        t.Errorf("expected division by zero. got=%v", err)
+    }
+}
+
+func BenchmarkEngines(b *testing.B) {
+    // no loops or functions yet, so the workload is a long straight line
+    var src strings.Builder
+    src.WriteString("let x = 1; let y = 2;")
+    for i := 0; i < 500; i++ {
+        src.WriteString("let x = (x * 3 + y) / 2 - y; let y = y + x * 2 - (x - 1);")
+        src.WriteString("if (x > y) { x - y } else { y - x };")
+    }
+    program := parse(src.String())
+
+    b.Run("stack", func(b *testing.B) {
+        comp := compiler.New()
+        err := comp.Compile(program)
+        if err != nil {
+            b.Fatalf("compiler error: %s", err)
+        }
+        bytecode := comp.Bytecode()
+
+        b.ResetTimer()
+        for i := 0; i < b.N; i++ {
+            err := vm.New(bytecode).Run()
+            if err != nil {
+                b.Fatalf("vm error: %s", err)
+            }
+        }
+    })
+
+    b.Run("register", func(b *testing.B) {
+        c := NewCompiler()
+        err := c.Compile(program)
+        if err != nil {
+            b.Fatalf("compiler error: %s", err)
+        }
+        p := c.Program()
+
+        b.ResetTimer()
+        for i := 0; i < b.N; i++ {
+            err := New(p).Run()
+            if err != nil {
+                b.Fatalf("vm error: %s", err)
+            }
+        }
+    })
+}
+
+func stackEngine(t *testing.T, input string) vm.Engine {
+    t.Helper()
+
+    comp := compiler.New()
+    err := comp.Compile(parse(input))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    return vm.New(comp.Bytecode())
+}
+
+func registerEngine(t *testing.T, input string) vm.Engine {
+    t.Helper()
+
+    c := NewCompiler()
+    err := c.Compile(parse(input))
+    if err != nil {
+        t.Fatalf("compiler error: %s", err)
+    }
+    return New(c.Program())
+}
+
+func TestGlobalsLimit(t *testing.T) {
+    err := New(&Program{NumGlobals: compiler.MaxGlobals + 1}).Run()
+    if err == nil || !strings.Contains(err.Error(), "the limit is") {
+        t.Errorf("expected an error for %d globals. got=%v", compiler.MaxGlobals + 1, err)
+    }
+
+    p := &Program{
+        Instructions: []Instruction{
+            {Op: OpLoadTrue, A: 0},
+            {Op: OpSetGlobal, A: vm.GlobalsSize, B: 0},
+        },
+        NumRegisters: 1,
+        NumGlobals: vm.GlobalsSize + 1,
+    }
+    err = NewWithGlobalsStore(p, make([]object.Object, vm.GlobalsSize)).Run()
+    if err == nil || !strings.Contains(err.Error(), "globals store too small") {
+        t.Errorf("expected an error for a short store. got=%v", err)
+    }
+
+    globals := make([]object.Object, vm.GlobalsSize + 1)
+    err = NewWithGlobalsStore(p, globals).Run()
+    if err != nil {
+        t.Fatalf("vm error: %s", err)
+    }
+    if globals[vm.GlobalsSize] != vm.True {
+        t.Errorf("global not stored in the caller's store. got=%v", globals[vm.GlobalsSize])
+    }
+}
+
+func runEngine(e vm.Engine) (object.Object, error) {
+    err := e.Run()
+    if err != nil {
+        return nil, err
+    }
+    return e.Result(), nil
+}
+
+// Inspect, or nil for no result.
+func inspect(obj object.Object) string {
+    if obj == nil {
+        return "nil"
+    }
+    return obj.Inspect()
+}
+
+func parse(input string) *ast.Program {
+    l := lexer.New(input)
+    p := parser.New(l)
+    return p.ParseProgram()
+}
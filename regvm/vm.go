@@ -0,0 +1,171 @@
+package regvm
+
+import (
+    "fmt"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+    "monkey_compiler/compiler"
+    "monkey_compiler/vm"
+)
+
+// VM interprets a Program on a register file.
+// Values and errors are the same as the stack VM's, both use the
+// operations of package vm.
+type VM struct {
+    instructions []Instruction
+    constants []object.Object
+    registers []object.Object
+    globals []object.Object
+
+    result object.Object
+
+    // why the program can't run, returned by Run
+    err error
+}
+
+func New(p *Program) *VM {
+    m := &VM{
+        instructions: p.Instructions,
+        constants: p.Constants,
+        registers: make([]object.Object, p.NumRegisters),
+    }
+
+    n := globalsSize(p)
+    if n > compiler.MaxGlobals {
+        m.err = fmt.Errorf("program has %d globals, the limit is %d", n, compiler.MaxGlobals)
+        n = vm.GlobalsSize
+    }
+    m.globals = make([]object.Object, n)
+
+    return m
+}
+
+// The same room as the stack VM, more when the program needs it.
+func globalsSize(p *Program) int {
+    if p.NumGlobals > vm.GlobalsSize {
+        return p.NumGlobals
+    }
+    return vm.GlobalsSize
+}
+
+// As vm.NewWithGlobalsStore, s must have room for every global.
+func NewWithGlobalsStore(p *Program, s []object.Object) *VM {
+    machine := New(p)
+    if machine.err == nil && len(s) < len(machine.globals) {
+        machine.err = fmt.Errorf("globals store too small: the program needs %d, the store has %d", len(machine.globals), len(s))
+    }
+    machine.globals = s
+    return machine
+}
+
+func (m *VM) Result() object.Object {
+    return m.result
+}
+
+func (m *VM) Run() error {
+    if m.err != nil {
+        return m.err
+    }
+
+    r := m.registers
+
+    for pc := 0; pc < len(m.instructions); pc++ {
+        ins := m.instructions[pc]
+
+        switch ins.Op {
+        case OpLoadConst:
+            r[ins.A] = m.constants[ins.B]
+
+        case OpLoadTrue:
+            r[ins.A] = vm.True
+
+        case OpLoadFalse:
+            r[ins.A] = vm.False
+
+        case OpLoadNull:
+            r[ins.A] = vm.Null
+
+        case OpGetGlobal:
+            r[ins.A] = m.globals[ins.B]
+
+        case OpSetGlobal:
+            m.globals[ins.A] = r[ins.B]
+
+        case OpMove:
+            r[ins.A] = r[ins.B]
+
+        case OpAdd, OpSub, OpMul, OpDiv:
+            result, err := vm.BinaryOperation(stackOpcodes[ins.Op], r[ins.B], r[ins.C])
+            if err != nil {
+                return err
+            }
+            r[ins.A] = result
+
+        case OpEq, OpNE, OpGT:
+            result, err := vm.Comparison(stackOpcodes[ins.Op], r[ins.B], r[ins.C])
+            if err != nil {
+                return err
+            }
+            r[ins.A] = result
+
+        case OpMinus:
+            result, err := vm.Minus(r[ins.B])
+            if err != nil {
+                return err
+            }
+            r[ins.A] = result
+
+        case OpBang:
+            r[ins.A] = vm.Bang(r[ins.B])
+
+        case OpJump:
+            pc = ins.A - 1
+
+        case OpJumpNotTruthy:
+            if !vm.IsTruthy(r[ins.B]) {
+                pc = ins.A - 1
+            }
+
+        case OpArray:
+            elems := make([]object.Object, ins.C)
+            copy(elems, r[ins.B:ins.B + ins.C])
+            r[ins.A] = &object.Array{Elems: elems}
+
+        case OpHash:
+            hash, err := vm.NewHash(r[ins.B:ins.B + ins.C])
+            if err != nil {
+                return err
+            }
+            r[ins.A] = hash
+
+        case OpConcat:
+            r[ins.A] = vm.Concat(r[ins.B:ins.B + ins.C])
+
+        case OpIndex:
+            result, err := vm.Index(r[ins.B], r[ins.C])
+            if err != nil {
+                return err
+            }
+            r[ins.A] = result
+
+        case OpResult:
+            m.result = r[ins.A]
+
+        default:
+            return fmt.Errorf("unknown opcode %s", ins.Op)
+        }
+    }
+
+    return nil
+}
+
+// The stack opcodes naming the shared operations.
+var stackOpcodes = [...]code.Opcode {
+    OpAdd: code.OpAdd,
+    OpSub: code.OpSub,
+    OpMul: code.OpMul,
+    OpDiv: code.OpDiv,
+    OpEq: code.OpEq,
+    OpNE: code.OpNE,
+    OpGT: code.OpGT,
+}
@@ -0,0 +1,18 @@
+package vm
+
+import (
+    "monkey_interpreter/object"
+)
+
+// Engine runs a compiled program.
+// The stack VM and regvm.VM both implement it.
+type Engine interface {
+    Run() error
+    // the value of the last top-level statement, the one a let binds for
+    // a let; nil when there are no statements
+    Result() object.Object
+}
+
+func (vm *VM) Result() object.Object {
+    return vm.LastPoppedStackElem()
+}
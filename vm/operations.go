@@ -0,0 +1,211 @@
+package vm
+
+import (
+    "fmt"
+    "strings"
+    "monkey_interpreter/object"
+    "monkey_compiler/code"
+)
+
+// The operations below don't touch the stack, so every engine evaluates
+// them the same way.
+
+// BinaryOperation evaluates OpAdd, OpSub, OpMul and OpDiv.
+func BinaryOperation(op code.Opcode, l, r object.Object) (object.Object, error) {
+    ltype := l.Type()
+    rtype := r.Type()
+
+    if ltype == object.INTEGER_OBJ && rtype == object.INTEGER_OBJ {
+        return binaryIntegerOperation(op, l, r)
+    }
+
+    if ltype == object.STRING_OBJ && rtype == object.STRING_OBJ {
+        return binaryStringOperation(op, l, r)
+    }
+
+    return nil, fmt.Errorf("invalid ltype or rtype")
+}
+
+func binaryIntegerOperation(op code.Opcode, l, r object.Object) (object.Object, error) {
+    lval := l.(*object.Integer).Value
+    rval := r.(*object.Integer).Value
+
+    var val int64
+    switch op {
+    case code.OpAdd:
+        val = lval + rval
+    case code.OpSub:
+        val = lval - rval
+    case code.OpMul:
+        val = lval * rval
+    case code.OpDiv:
+        if rval == 0 {
+            return nil, fmt.Errorf("division by zero")
+        }
+        val = lval / rval
+    default:
+        return nil, fmt.Errorf("invalid operator")
+    }
+    return &object.Integer{Value: val}, nil
+}
+
+func binaryStringOperation(op code.Opcode, l, r object.Object) (object.Object, error) {
+    lval := l.(*object.String).Value
+    rval := r.(*object.String).Value
+
+    if op != code.OpAdd {
+        return nil, fmt.Errorf("String has only `+` operator")
+    }
+    return &object.String{Value: lval + rval}, nil
+}
+
+// Comparison evaluates OpEq, OpNE and OpGT.
+func Comparison(op code.Opcode, lExp, rExp object.Object) (object.Object, error) {
+    if lExp.Type() == object.INTEGER_OBJ || rExp.Type() == object.INTEGER_OBJ {
+        return integerComparison(op, lExp, rExp)
+    }
+    if lExp.Type() == object.STRING_OBJ && rExp.Type() == object.STRING_OBJ {
+        return stringComparison(op, lExp, rExp)
+    }
+
+    switch op {
+    case code.OpEq:
+        return nativeBoolToBooleanObject(lExp == rExp), nil
+    case code.OpNE:
+        return nativeBoolToBooleanObject(lExp != rExp), nil
+    default:
+        return nil, fmt.Errorf("unknown operator")
+    }
+}
+
+func integerComparison(op code.Opcode, l, r object.Object) (object.Object, error) {
+    lval := l.(*object.Integer).Value
+    rval := r.(*object.Integer).Value
+
+    switch op {
+    case code.OpEq:
+        return nativeBoolToBooleanObject(lval == rval), nil
+    case code.OpNE:
+        return nativeBoolToBooleanObject(lval != rval), nil
+    case code.OpGT:
+        return nativeBoolToBooleanObject(lval > rval), nil
+    default:
+        return nil, fmt.Errorf("unknown operator")
+    }
+}
+
+// Strings are equal when their contents are, wherever they came from.
+func stringComparison(op code.Opcode, l, r object.Object) (object.Object, error) {
+    lval := l.(*object.String).Value
+    rval := r.(*object.String).Value
+
+    switch op {
+    case code.OpEq:
+        return nativeBoolToBooleanObject(lval == rval), nil
+    case code.OpNE:
+        return nativeBoolToBooleanObject(lval != rval), nil
+    default:
+        return nil, fmt.Errorf("unknown operator")
+    }
+}
+
+// Index evaluates OpIndex. Missing elements are Null.
+func Index(left, index object.Object) (object.Object, error) {
+    switch {
+    case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
+        elems := left.(*object.Array).Elems
+        i := index.(*object.Integer).Value
+        if i < 0 || i >= int64(len(elems)) {
+            return Null, nil
+        }
+        return elems[i], nil
+
+    case left.Type() == object.HASH_OBJ:
+        key, ok := index.(object.Hashable)
+        if !ok {
+            return nil, fmt.Errorf("unusable as hash key")
+        }
+        pair, ok := left.(*object.Hash).Pairs[key.HashKey()]
+        if !ok {
+            return Null, nil
+        }
+        return pair.Value, nil
+
+    default:
+        return nil, fmt.Errorf("index operator not supported")
+    }
+}
+
+// Bang evaluates OpBang.
+func Bang(operand object.Object) object.Object {
+    switch operand {
+    case True:
+        return False
+    case False:
+        return True
+    case Null:
+        return True
+    default:
+        return False
+    }
+}
+
+// Minus evaluates OpMinus.
+func Minus(operand object.Object) (object.Object, error) {
+    if operand.Type() != object.INTEGER_OBJ {
+        return nil, fmt.Errorf("invalid operand")
+    }
+
+    value := operand.(*object.Integer).Value
+    return &object.Integer{Value: -value}, nil
+}
+
+// IsTruthy reports how OpJumpNotTruthy sees a value.
+func IsTruthy(obj object.Object) bool {
+    return isTruthy(obj)
+}
+
+// Concat evaluates OpConcat: the values are stringified and joined into
+// one String with a single allocation.
+func Concat(values []object.Object) object.Object {
+    strs := make([]string, len(values))
+    size := 0
+
+    for i, v := range values {
+        if s, ok := v.(*object.String); ok {
+            strs[i] = s.Value
+        } else {
+            strs[i] = v.Inspect()
+        }
+        size += len(strs[i])
+    }
+
+    var b strings.Builder
+    b.Grow(size)
+    for _, s := range strs {
+        b.WriteString(s)
+    }
+
+    return &object.String{Value: b.String()}
+}
+
+// NewHash evaluates OpHash from alternating keys and values.
+func NewHash(kvs []object.Object) (object.Object, error) {
+    hashedPairs := make(map[object.HashKey]object.HashPair)
+
+    for i := 0; i < len(kvs); i += 2 {
+        key := kvs[i]
+        val := kvs[i + 1]
+
+        pair := object.HashPair{Key: key, Value: val}
+
+        hashKey, ok := key.(object.Hashable)
+        if !ok {
+            return nil, fmt.Errorf("unusable as hash key")
+        }
+
+        hashedPairs[hashKey.HashKey()] = pair
+    }
+
+    return &object.Hash{Pairs: hashedPairs}, nil
+}
@@ -0,0 +1,101 @@
+package vm
+
+import (
+    "sort"
+    "strings"
+    "monkey_compiler/code"
+)
+
+// Longest opcode sequence a Profile counts.
+const MaxSequenceLength = 3
+
+// Profile counts executed opcodes and the sequences they form when one
+// falls through to the next. A sequence is broken by any taken jump.
+// The same Profile may be shared by several VMs to aggregate traces.
+type Profile struct {
+    Ops map[code.Opcode]int
+    // key is the opcodes of the sequence as bytes
+    sequences map[string]int
+    window []byte
+}
+
+// A sequence of opcodes and how often it was executed.
+type Candidate struct {
+    Ops []code.Opcode
+    Count int
+}
+
+func NewProfile() *Profile {
+    return &Profile{
+        Ops: make(map[code.Opcode]int),
+        sequences: make(map[string]int),
+        window: []byte{},
+    }
+}
+
+func (vm *VM) SetProfile(p *Profile) {
+    vm.profile = p
+}
+
+// Record the instruction executed at ip, which continued at next.
+func (p *Profile) record(ins code.Instructions, ip int, next int) {
+    decoded, _, width, err := code.ReadInstruction(ins[ip:])
+    if err != nil {
+        p.window = p.window[:0]
+        return
+    }
+    op := byte(decoded)
+    p.Ops[decoded]++
+
+    if len(p.window) == MaxSequenceLength {
+        p.window = p.window[1:]
+    }
+    p.window = append(p.window, op)
+
+    for n := 2; n <= len(p.window); n++ {
+        p.sequences[string(p.window[len(p.window) - n:])]++
+    }
+
+    if next != ip + width {
+        p.window = p.window[:0]
+    }
+}
+
+// The most executed sequences of the given length, most frequent first.
+// These are the candidates for new superinstructions.
+func (p *Profile) Candidates(length int) []Candidate {
+    candidates := []Candidate{}
+
+    for key, count := range p.sequences {
+        if len(key) != length {
+            continue
+        }
+        ops := make([]code.Opcode, len(key))
+        for i := range key {
+            ops[i] = code.Opcode(key[i])
+        }
+        candidates = append(candidates, Candidate{Ops: ops, Count: count})
+    }
+
+    sort.Slice(candidates, func(i, j int) bool {
+        if candidates[i].Count != candidates[j].Count {
+            return candidates[i].Count > candidates[j].Count
+        }
+        return candidates[i].String() < candidates[j].String()
+    })
+
+    return candidates
+}
+
+func (c Candidate) String() string {
+    names := make([]string, len(c.Ops))
+    for i, op := range c.Ops {
+        def, err := code.Lookup(byte(op))
+        if err != nil {
+            names[i] = "?"
+            continue
+        }
+        names[i] = def.Name
+    }
+    return strings.Join(names, " ")
+}
@@ -8,6 +8,7 @@ import (
 )
 
 const StackSize = 2048
+// Globals a VM has room for at least, more when the bytecode uses more.
 const GlobalsSize = 65536
 
 type VM struct{
@@ -16,6 +17,23 @@ type VM struct{
     stack []object.Object
     sp int // always points to the next value. Top of stack is stack[sp-1]
     globals []object.Object
+    handlers []compiler.Handler
+    jumpTables []compiler.JumpTable
+
+    // nil unless profiling
+    profile *Profile
+
+    // why the bytecode can't run, returned by Run
+    err error
+}
+
+// Exception is returned from Run when a thrown value is not caught.
+type Exception struct {
+    Value object.Object
+}
+
+func (e *Exception) Error() string {
+    return fmt.Sprintf("uncaught exception: %s", e.Value.Inspect())
 }
 
 var True = &object.Boolean{Value: true}
@@ -28,242 +46,331 @@ func New(bytecode *compiler.Bytecode) *VM {
         constants: bytecode.Constants,
         stack: make([]object.Object, StackSize),
         sp: 0,
-        globals: make([]object.Object, GlobalsSize),
+        handlers: bytecode.Handlers,
+        jumpTables: bytecode.JumpTables,
+    }
+
+    n := numGlobals(bytecode.Instructions)
+    if n > compiler.MaxGlobals {
+        vm.err = fmt.Errorf("bytecode uses global %d, the limit is %d", n - 1, compiler.MaxGlobals)
+        n = GlobalsSize
     }
+    vm.globals = make([]object.Object, n)
 
     return vm
 }
 
+// s must have room for every global of the bytecode, otherwise Run fails.
+// It is never replaced, so a REPL can share it between runs.
 func NewWithGlobalsStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
     vm := New(bytecode)
+    if vm.err == nil && len(s) < len(vm.globals) {
+        vm.err = fmt.Errorf("globals store too small: the bytecode needs %d, the store has %d", len(vm.globals), len(s))
+    }
     vm.globals = s
     return vm
 }
 
-func (vm *VM) Run() error {
-    for ip := 0; ip < len(vm.instructions); ip++ {
-
-        op := code.Opcode(vm.instructions[ip])
+// Size of the globals store for ins: GlobalsSize, or one more than the
+// largest global operand when that is larger.
+func numGlobals(ins code.Instructions) int {
+    n := GlobalsSize
+    d := code.NewDecoder(ins)
+    for d.Next() {
+        inst := d.Instruction()
+        def, _ := code.Lookup(byte(inst.Op))
+        for i, operand := range inst.Operands {
+            if def.OperandKind(i) == code.OperandGlobal && operand >= n {
+                n = operand + 1
+            }
+        }
+    }
+    return n
+}
 
-        switch op {
-        case code.OpConst:
-            constIndex := code.ReadUint16(vm.instructions[ip+1:])
-            ip += 2
+func (vm *VM) Run() error {
+    if vm.err != nil {
+        return vm.err
+    }
 
-            err := vm.push(vm.constants[constIndex])
+    ip := 0
+    for ip < len(vm.instructions) {
+        next, err := vm.execute(ip)
+        if vm.profile != nil {
+            vm.profile.record(vm.instructions, ip, next)
+        }
+        if err != nil {
+            next, err = vm.handleException(ip, err)
             if err != nil {
                 return err
             }
+        }
+        ip = next
+    }
 
-        case code.OpSetGlobal:
-            globalIndex := code.ReadUint16(vm.instructions[ip+1:])
-            ip += 2
-            vm.globals[globalIndex] = vm.pop()
+    return nil
+}
 
-        case code.OpGetGlobal:
-            globalIndex := code.ReadUint16(vm.instructions[ip+1:])
-            ip += 2
-            err := vm.push(vm.globals[globalIndex])
-            if err != nil {
-                return err
-            }
+// Execute the instruction at ip and return the position of the next one.
+func (vm *VM) execute(ip int) (int, error) {
+    op := code.Opcode(vm.instructions[ip])
+    wide := op == code.OpWide
+    if wide {
+        ip++
+        op = code.Opcode(vm.instructions[ip])
+    }
+    width := code.OperandWidth(wide)
 
-        case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
-            err := vm.executeBinaryOperation(op)
-            if err != nil {
-                return err
-            }
+    switch op {
+    case code.OpConst:
+        constIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
 
-        case code.OpTrue:
-            err := vm.push(True)
-            if err != nil {
-                return err
-            }
+        err := vm.push(vm.constants[constIndex])
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpFalse:
-            err := vm.push(False)
-            if err != nil {
-                return err
-            }
+    case code.OpSetGlobal:
+        globalIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
+        vm.globals[globalIndex] = vm.pop()
+
+    case code.OpGetGlobal:
+        globalIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
+        err := vm.push(vm.globals[globalIndex])
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpBang:
-            err := vm.executeBangOperator()
-            if err != nil {
-                return nil
-            }
+    case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+        r := vm.pop()
+        l := vm.pop()
+        err := vm.executeBinaryOperation(op, l, r)
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpMinus:
-            err := vm.executeMinusOperator()
-            if err != nil {
-                return err
-            }
+    case code.OpTrue:
+        err := vm.push(True)
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpEq, code.OpNE, code.OpGT:
-            err := vm.executeComparison(op)
-            if err != nil {
-                return err
-            }
+    case code.OpFalse:
+        err := vm.push(False)
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpPop:
-            vm.pop()
+    case code.OpBang:
+        err := vm.executeBangOperator()
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpJump:
-            jumpDst := code.ReadUint16(vm.instructions[ip+1:])
-            ip = int(jumpDst) - 1
+    case code.OpMinus:
+        err := vm.executeMinusOperator()
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpJumpNotTruthy:
-            jumpDst := code.ReadUint16(vm.instructions[ip+1:])
-            ip += 2
+    case code.OpEq, code.OpNE, code.OpGT:
+        r := vm.pop()
+        l := vm.pop()
+        err := vm.executeComparison(op, l, r)
+        if err != nil {
+            return ip, err
+        }
 
-            cond := vm.pop()
-            if !isTruthy(cond) {
-                ip = int(jumpDst) - 1
-            }
+    case code.OpPop:
+        vm.pop()
 
-        case code.OpArray:
-            len := int(code.ReadUint16(vm.instructions[ip+1:]))
-            ip += 2
+    case code.OpJump:
+        jumpDst := code.ReadOperand(vm.instructions, ip+1, wide)
+        return jumpDst, nil
 
-            arr := vm.buildArray(vm.sp - len, vm.sp)
-            vm.sp -= len
+    case code.OpJumpNotTruthy:
+        jumpDst := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
 
-            err := vm.push(arr)
-            if err != nil {
-                return err
-            }
+        cond := vm.pop()
+        if !isTruthy(cond) {
+            return jumpDst, nil
+        }
 
-        case code.OpHash:
-            len := int(code.ReadUint16(vm.instructions[ip+1:]))
-            ip += 2
+    case code.OpArray:
+        len := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
 
-            hash, err := vm.buildHash(vm.sp - len, vm.sp)
-            if err != nil {
-                return err
-            }
-            vm.sp -= len
+        arr := vm.buildArray(vm.sp - len, vm.sp)
+        vm.sp -= len
 
-            err = vm.push(hash)
-            if err != nil {
-                return err
-            }
+        err := vm.push(arr)
+        if err != nil {
+            return ip, err
+        }
 
-        case code.OpNull:
-            err := vm.push(Null)
-            if err != nil {
-                return err
-            }
+    case code.OpHash:
+        len := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
+
+        hash, err := vm.buildHash(vm.sp - len, vm.sp)
+        if err != nil {
+            return ip, err
         }
-    }
+        vm.sp -= len
 
-    return nil
-}
+        err = vm.push(hash)
+        if err != nil {
+            return ip, err
+        }
 
-func (vm *VM) executeBinaryOperation(op code.Opcode) error {
-    r := vm.pop()
-    l := vm.pop()
-    ltype := l.Type()
-    rtype := r.Type()
+    case code.OpIndex:
+        index := vm.pop()
+        left := vm.pop()
 
-    if ltype == object.INTEGER_OBJ && rtype == object.INTEGER_OBJ {
-        return vm.executeBinaryIntegerOperation(op, l, r)
-    }
+        err := vm.executeIndexExpression(left, index)
+        if err != nil {
+            return ip, err
+        }
+
+    case code.OpNull:
+        err := vm.push(Null)
+        if err != nil {
+            return ip, err
+        }
+
+    case code.OpThrow:
+        return ip, &Exception{Value: vm.pop()}
+
+    case code.OpConcat:
+        n := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
+
+        str := vm.concat(vm.sp - n, vm.sp)
+        vm.sp -= n
+
+        err := vm.push(str)
+        if err != nil {
+            return ip, err
+        }
+
+    // superinstructions, see compiler.fuse
+
+    case code.OpGetGlobalConstAdd:
+        globalIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        constIndex := code.ReadOperand(vm.instructions, ip+1+width, wide)
+        ip += 2 * width
+
+        err := vm.executeBinaryOperation(code.OpAdd, vm.globals[globalIndex], vm.constants[constIndex])
+        if err != nil {
+            return ip, err
+        }
+
+    case code.OpConstGT:
+        constIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
+
+        l := vm.pop()
+        err := vm.executeComparison(code.OpGT, l, vm.constants[constIndex])
+        if err != nil {
+            return ip, err
+        }
 
-    if ltype == object.STRING_OBJ && rtype == object.STRING_OBJ {
-        return vm.executeBinaryStringOperation(op, l, r)
+    case code.OpGetGlobalIndex:
+        globalIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        ip += width
+
+        left := vm.pop()
+        err := vm.executeIndexExpression(left, vm.globals[globalIndex])
+        if err != nil {
+            return ip, err
+        }
+
+    case code.OpJumpTable:
+        tableIndex := code.ReadOperand(vm.instructions, ip+1, wide)
+        return jumpTableTarget(vm.jumpTables[tableIndex], vm.pop()), nil
     }
 
-    return fmt.Errorf("invalid ltype or rtype")
+    return ip + 1, nil
 }
 
-func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, l, r object.Object) error {
-    lval := l.(*object.Integer).Value
-    rval := r.(*object.Integer).Value
+// Unwind to the innermost handler covering ip.
+// The error is given back when no handler covers it.
+func (vm *VM) handleException(ip int, err error) (int, error) {
+    for _, h := range vm.handlers {
+        if ip < h.Start || h.End <= ip {
+            continue
+        }
 
-    var val int64
-    switch op {
-    case code.OpAdd:
-        val = lval + rval
-    case code.OpSub:
-        val = lval - rval
-    case code.OpMul:
-        val = lval * rval
-    case code.OpDiv:
-        val = lval / rval
-    default:
-        return fmt.Errorf("invalid operator")
+        vm.sp = h.StackDepth
+        perr := vm.push(exceptionValue(err))
+        if perr != nil {
+            return ip, perr
+        }
+        return h.Target, nil
     }
-    o := &object.Integer{Value: val}
-    return vm.push(o)
+
+    return ip, err
 }
 
-func (vm *VM) executeBinaryStringOperation(op code.Opcode, l, r object.Object) error {
-    lval := l.(*object.String).Value
-    rval := r.(*object.String).Value
+func jumpTableTarget(table compiler.JumpTable, obj object.Object) int {
+    integer, ok := obj.(*object.Integer)
+    if !ok {
+        return table.Default
+    }
 
-    if op != code.OpAdd {
-        return fmt.Errorf("String has only `+` operator")
+    // Value - Min overflows when they are far apart
+    if integer.Value < table.Min || uint64(integer.Value - table.Min) >= uint64(len(table.Targets)) {
+        return table.Default
     }
-    o := &object.String{Value: lval + rval}
-    return vm.push(o)
+    return table.Targets[integer.Value - table.Min]
 }
 
-func (vm *VM) executeComparison(op code.Opcode) error {
-    rExp := vm.pop()
-    lExp := vm.pop()
-
-    if lExp.Type() == object.INTEGER_OBJ || rExp.Type() == object.INTEGER_OBJ {
-        return vm.executeIntegerComparison(op, lExp, rExp)
+// Runtime errors are caught as Error objects, thrown values as they are.
+func exceptionValue(err error) object.Object {
+    if e, ok := err.(*Exception); ok {
+        return e.Value
     }
+    return &object.Error{Message: err.Error()}
+}
 
-    switch op {
-    case code.OpEq:
-        return vm.push(nativeBoolToBooleanObject(lExp == rExp))
-    case code.OpNE:
-        return vm.push(nativeBoolToBooleanObject(lExp != rExp))
-    default:
-        return fmt.Errorf("unknown operator")
+func (vm *VM) executeBinaryOperation(op code.Opcode, l, r object.Object) error {
+    result, err := BinaryOperation(op, l, r)
+    if err != nil {
+        return err
     }
+    return vm.push(result)
 }
 
-func (vm *VM) executeIntegerComparison(op code.Opcode, l, r object.Object) error {
-    lval := l.(*object.Integer).Value
-    rval := r.(*object.Integer).Value
+func (vm *VM) executeComparison(op code.Opcode, l, r object.Object) error {
+    result, err := Comparison(op, l, r)
+    if err != nil {
+        return err
+    }
+    return vm.push(result)
+}
 
-    switch op {
-    case code.OpEq:
-        return vm.push(nativeBoolToBooleanObject(lval == rval))
-    case code.OpNE:
-        return vm.push(nativeBoolToBooleanObject(lval != rval))
-    case code.OpGT:
-        return vm.push(nativeBoolToBooleanObject(lval > rval))
-    default:
-        return fmt.Errorf("unknown operator")
+func (vm *VM) executeIndexExpression(left, index object.Object) error {
+    result, err := Index(left, index)
+    if err != nil {
+        return err
     }
+    return vm.push(result)
 }
 
 func (vm *VM) executeBangOperator() error {
-    operand := vm.pop()
-
-    switch operand {
-    case True:
-        return vm.push(False)
-    case False:
-        return vm.push(True)
-    case Null:
-        return vm.push(True)
-    default:
-        return vm.push(False)
-    }
+    return vm.push(Bang(vm.pop()))
 }
 
 func (vm *VM) executeMinusOperator() error {
-    operand := vm.pop()
-    if operand.Type() != object.INTEGER_OBJ {
-        return fmt.Errorf("invalid operand")
+    result, err := Minus(vm.pop())
+    if err != nil {
+        return err
     }
-
-    value := operand.(*object.Integer).Value
-    return vm.push(&object.Integer{Value: -value})
+    return vm.push(result)
 }
 
 func nativeBoolToBooleanObject(b bool) *object.Boolean {
@@ -283,24 +390,12 @@ func (vm *VM) buildArray(startIndex int, endIndex int) object.Object {
     return &object.Array{Elems: elems}
 }
 
-func (vm *VM) buildHash(startIndex int, endIndex int) (object.Object, error) {
-    hashedPairs := make(map[object.HashKey]object.HashPair)
-
-    for i := startIndex; i < endIndex; i += 2 {
-        key := vm.stack[i]
-        val := vm.stack[i + 1]
-
-        pair := object.HashPair{Key: key, Value: val}
-
-        hashKey, ok := key.(object.Hashable)
-        if !ok {
-            return nil, fmt.Errorf("unusable as hash key")
-        }
-
-        hashedPairs[hashKey.HashKey()] = pair
-    }
+func (vm *VM) concat(startIndex int, endIndex int) object.Object {
+    return Concat(vm.stack[startIndex:endIndex])
+}
 
-    return &object.Hash{Pairs: hashedPairs}, nil
+func (vm *VM) buildHash(startIndex int, endIndex int) (object.Object, error) {
+    return NewHash(vm.stack[startIndex:endIndex])
 }
 
 func (vm *VM) StackTop() object.Object {
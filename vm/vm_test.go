@@ -2,11 +2,14 @@ package vm
 
 import (
     "fmt"
+    "math"
+    "strings"
     "testing"
     "monkey_interpreter/ast"
     "monkey_interpreter/lexer"
     "monkey_interpreter/parser"
     "monkey_interpreter/object"
+    "monkey_compiler/code"
     "monkey_compiler/compiler"
 )
 
@@ -80,6 +83,9 @@ func TestConditionals(t *testing.T) {
         {"if (1 > 2) { 10 }", Null},
         {"if (false) { 10 }", Null},
         {"if (if (false) { 10 }) { 10 } else { 20 }", 20},
+        {"if (true) { }", Null},
+        {"1; if (true) { }", Null},
+        {"if (1 > 2) { 10 } else { let z = 1 }", Null},
     }
 
     runVmTest(t, tests)
@@ -100,6 +106,18 @@ func TestStringExpressions(t *testing.T) {
         {`"monkey"`, "monkey"},
         {`"mon" + "key"`, "monkey"},
         {`"mon" + "key" + "ship"`, "monkeyship"},
+        {`let name = "monkey"; "Hello ${name}"`, "Hello monkey"},
+        {`let n = 2; "${n} + ${n} = ${n + n}"`, "2 + 2 = 4"},
+        {`"${true}, ${[1, 2]}"`, "true, [1, 2]"},
+        {`let n = 1; "\${n} is ${n}"`, "${n} is 1"},
+        {`"\${" + "}"`, "${}"},
+        {`"a" == "a"`, true},
+        {`"a" + "b" == "a" + "b"`, true},
+        {`"ab" != "a" + "b"`, false},
+        {`let n = 1; "${n}" == "${1}"`, true},
+        {`"a" == "b"`, false},
+        {`"a" != "b"`, true},
+        {`let s = "x"; [s][0] == "x"`, true},
     }
 
     runVmTest(t, tests)
@@ -140,6 +158,531 @@ func TestHashLiterals(t *testing.T) {
     runVmTest(t, tests)
 }
 
+func TestConstantFolding(t *testing.T) {
+    inputs := []string {
+        "(5 + 10 * 2 + 15 / 3) * 2 + -10",
+        "-7 / 2",
+        "1 < 2 == true",
+        "!5",
+        "!!false != true",
+        `"mon" + "key" + "ship"`,
+        `"a" == "a"`,
+        `"a" + "b" == "a" + "b"`,
+        `"${1}" == "${1}"`,
+        `"ab" != "a" + "b"`,
+        `"a" == "b"`,
+        "let x = 4; x * (2 + 3)",
+    }
+
+    for _, input := range inputs {
+        plain := runWithOptions(t, input, compiler.Options{})
+        folded := runWithOptions(t, input, compiler.Options{FoldConstants: true})
+
+        if plain.Inspect() != folded.Inspect() {
+            t.Errorf("folding changed the result of %q. want=%s, got=%s",
+                input, plain.Inspect(), folded.Inspect())
+        }
+    }
+
+    comp := compiler.New()
+    comp.SetOptions(compiler.Options{FoldConstants: true})
+    err := comp.Compile(parse("1 / (2 - 2)"))
+    if err != nil {
+        t.Fatalf("compiler err: %s", err)
+    }
+    err = New(comp.Bytecode()).Run()
+    if err == nil || err.Error() != "division by zero" {
+        t.Errorf("expected division by zero at runtime. got=%v", err)
+    }
+}
+
+func TestPeepholeOptimizer(t *testing.T) {
+    inputs := []string {
+        "if (true) { 10 } else { 20 }",
+        "if (false) { 10 }",
+        "if (if (false) { 10 }) { 10 } else { 20 }",
+        "if (1 < 2) { 10 } else { 20 }",
+        `if ("") { 10 } else { 20 }`,
+        "let x = 0; if (!!x) { 1 } else { 2 }",
+        "let x = 1; 2; x; 3; x + 1",
+        "!(if (false) { 5; })",
+        `let one = 1; let two = one + one; "${one + two}"`,
+    }
+
+    for _, input := range inputs {
+        plain := runWithOptions(t, input, compiler.Options{})
+        optimized := runWithOptions(t, input, compiler.Options{
+            Peephole: true,
+            FoldConstants: true,
+            DeadBranches: true,
+        })
+
+        if plain.Inspect() != optimized.Inspect() {
+            t.Errorf("optimizer changed the result of %q. want=%s, got=%s",
+                input, plain.Inspect(), optimized.Inspect())
+        }
+    }
+}
+
+func runWithOptions(t *testing.T, input string, opts compiler.Options) object.Object {
+    t.Helper()
+
+    comp := compiler.New()
+    comp.SetOptions(opts)
+    err := comp.Compile(parse(input))
+    if err != nil {
+        t.Fatalf("compiler err: %s", err)
+    }
+
+    vm := New(comp.Bytecode())
+    err = vm.Run()
+    if err != nil {
+        t.Fatalf("vm err: %s", err)
+    }
+
+    return vm.LastPoppedStackElem()
+}
+
+func TestExceptionHandlers(t *testing.T) {
+    // 0000 OpConst 0
+    // 0003 OpConst 1
+    // 0006 OpAdd      <- Integer + String fails here
+    // 0007 OpPop
+    // 0008 OpJump 12
+    // 0011 OpPop      <- handler target, pops the caught value
+    runtimeError := &compiler.Bytecode{
+        Instructions: concatInstructions(
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpConst, 1),
+            code.Make(code.OpAdd),
+            code.Make(code.OpPop),
+            code.Make(code.OpJump, 12),
+            code.Make(code.OpPop),
+        ),
+        Constants: []object.Object{
+            &object.Integer{Value: 1},
+            &object.String{Value: "a"},
+        },
+        Handlers: []compiler.Handler{
+            {Start: 0, End: 8, Target: 11, StackDepth: 0},
+        },
+    }
+
+    vm := New(runtimeError)
+    err := vm.Run()
+    if err != nil {
+        t.Fatalf("vm err: %s", err)
+    }
+    caught, ok := vm.LastPoppedStackElem().(*object.Error)
+    if !ok {
+        t.Fatalf("object is not Error. got=%T", vm.LastPoppedStackElem())
+    }
+    if caught.Message != "invalid ltype or rtype" {
+        t.Errorf("wrong error message. got=%q", caught.Message)
+    }
+
+    // 0000 OpConst 0
+    // 0003 OpConst 1
+    // 0006 OpThrow    <- inner handler, then rethrown to the outer one
+    // 0007 OpThrow
+    // 0008 OpPop      <- outer handler target
+    nested := &compiler.Bytecode{
+        Instructions: concatInstructions(
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpConst, 1),
+            code.Make(code.OpThrow),
+            code.Make(code.OpThrow),
+            code.Make(code.OpPop),
+        ),
+        Constants: []object.Object{
+            &object.Integer{Value: 1},
+            &object.Integer{Value: 42},
+        },
+        Handlers: []compiler.Handler{
+            {Start: 3, End: 7, Target: 7, StackDepth: 1},
+            {Start: 0, End: 8, Target: 8, StackDepth: 0},
+        },
+    }
+
+    vm = New(nested)
+    err = vm.Run()
+    if err != nil {
+        t.Fatalf("vm err: %s", err)
+    }
+    testExpectedObject(t, 42, vm.LastPoppedStackElem())
+    if vm.sp != 0 {
+        t.Errorf("stack not unwound. sp=%d", vm.sp)
+    }
+
+    uncaught := &compiler.Bytecode{
+        Instructions: concatInstructions(
+            code.Make(code.OpConst, 0),
+            code.Make(code.OpThrow),
+        ),
+        Constants: []object.Object{&object.Integer{Value: 42}},
+    }
+
+    err = New(uncaught).Run()
+    exc, ok := err.(*Exception)
+    if !ok {
+        t.Fatalf("err is not Exception. got=%v", err)
+    }
+    testExpectedObject(t, 42, exc.Value)
+}
+
+func TestJumpTable(t *testing.T) {
+    // 0000 OpGetGlobal 0
+    // 0003 OpJumpTable 0
+    // 0006 OpConst 0      <- case 1
+    // 0009 OpJump 21
+    // 0012 OpConst 1      <- case 2, 3
+    // 0015 OpJump 21
+    // 0018 OpConst 2      <- default
+    // 0021 OpPop
+    instructions := concatInstructions(
+        code.Make(code.OpGetGlobal, 0),
+        code.Make(code.OpJumpTable, 0),
+        code.Make(code.OpConst, 0),
+        code.Make(code.OpJump, 21),
+        code.Make(code.OpConst, 1),
+        code.Make(code.OpJump, 21),
+        code.Make(code.OpConst, 2),
+        code.Make(code.OpPop),
+    )
+
+    tests := []struct {
+        subject object.Object
+        expected int
+    }{
+        {&object.Integer{Value: 1}, 10},
+        {&object.Integer{Value: 2}, 20},
+        {&object.Integer{Value: 3}, 20},
+        {&object.Integer{Value: 0}, 30},
+        {&object.Integer{Value: 4}, 30},
+        {&object.String{Value: "1"}, 30},
+    }
+
+    for _, test := range tests {
+        bytecode := &compiler.Bytecode{
+            Instructions: instructions,
+            Constants: []object.Object{
+                &object.Integer{Value: 10},
+                &object.Integer{Value: 20},
+                &object.Integer{Value: 30},
+            },
+            JumpTables: []compiler.JumpTable{
+                {Min: 1, Targets: []int{6, 12, 12}, Default: 18},
+            },
+        }
+
+        globals := make([]object.Object, GlobalsSize)
+        globals[0] = test.subject
+
+        vm := NewWithGlobalsStore(bytecode, globals)
+        err := vm.Run()
+        if err != nil {
+            t.Fatalf("vm err: %s", err)
+        }
+        testExpectedObject(t, test.expected, vm.LastPoppedStackElem())
+    }
+}
+
+func TestJumpTableTargetFarFromMin(t *testing.T) {
+    tests := []struct {
+        table compiler.JumpTable
+        subject int64
+        expected int
+    }{
+        // Value - Min wraps around to 2
+        {compiler.JumpTable{Min: math.MaxInt64, Targets: []int{1, 2, 3}, Default: 9}, math.MinInt64 + 1, 9},
+        // and to -1
+        {compiler.JumpTable{Min: math.MinInt64, Targets: []int{1, 2, 3}, Default: 9}, math.MaxInt64, 9},
+        {compiler.JumpTable{Min: math.MinInt64, Targets: []int{1, 2, 3}, Default: 9}, math.MinInt64 + 2, 3},
+        {compiler.JumpTable{Min: math.MaxInt64 - 2, Targets: []int{1, 2, 3}, Default: 9}, math.MaxInt64, 3},
+    }
+
+    for _, test := range tests {
+        target := jumpTableTarget(test.table, &object.Integer{Value: test.subject})
+        if target != test.expected {
+            t.Errorf("target for %d with min %d. want=%d, got=%d",
+                test.subject, test.table.Min, test.expected, target)
+        }
+    }
+}
+
+func concatInstructions(insts ...[]byte) code.Instructions {
+    out := code.Instructions{}
+    for _, ins := range insts {
+        out = append(out, ins...)
+    }
+    return out
+}
+
+func TestIndexExpressions(t *testing.T) {
+    tests := []vmTestCase {
+        {"[1, 2, 3][1]", 2},
+        {"[1, 2, 3][0 + 2]", 3},
+        {"[[1, 1, 1]][0][0]", 1},
+        {"[][0]", Null},
+        {"[1, 2, 3][99]", Null},
+        {"[1][-1]", Null},
+        {"{1: 1, 2: 2}[1]", 1},
+        {"{1: 1, 2: 2}[2]", 2},
+        {"{1: 1}[0]", Null},
+        {"{}[0]", Null},
+    }
+
+    runVmTest(t, tests)
+}
+
+func TestSuperinstructions(t *testing.T) {
+    inputs := []string {
+        "let x = 1; x + 2",
+        `let s = "mon"; s + "key"`,
+        "let x = 1; x > 2",
+        "let x = 3; x > 2",
+        "let x = 1; (if (x) { x } else { 0 }) > 2",
+        "let a = [1, 2]; let i = 1; a[i]",
+        "let h = {1: 2}; let k = 1; h[k] + 1",
+    }
+
+    for _, input := range inputs {
+        plain := runWithOptions(t, input, compiler.Options{})
+        fused := runWithOptions(t, input, compiler.Options{Superinstructions: true})
+
+        if plain.Inspect() != fused.Inspect() {
+            t.Errorf("superinstructions changed the result of %q. want=%s, got=%s",
+                input, plain.Inspect(), fused.Inspect())
+        }
+    }
+}
+
+func TestProfile(t *testing.T) {
+    comp := compiler.New()
+    err := comp.Compile(parse("let x = 1; x + 2; x + 3; if (x > 1) { x + 4 }"))
+    if err != nil {
+        t.Fatalf("compiler err: %s", err)
+    }
+
+    profile := NewProfile()
+    vm := New(comp.Bytecode())
+    vm.SetProfile(profile)
+    err = vm.Run()
+    if err != nil {
+        t.Fatalf("vm err: %s", err)
+    }
+
+    if profile.Ops[code.OpAdd] != 2 {
+        t.Errorf("wrong OpAdd count. want=2, got=%d", profile.Ops[code.OpAdd])
+    }
+
+    candidates := profile.Candidates(3)
+    if len(candidates) == 0 || candidates[0].Count != 2 {
+        t.Fatalf("wrong candidates. got=%v", candidates)
+    }
+    found := false
+    for _, c := range candidates {
+        if c.String() == "OpGetGlobal OpConst OpAdd" && c.Count == 2 {
+            found = true
+        }
+    }
+    if !found {
+        t.Errorf("OpGetGlobal OpConst OpAdd not counted twice. got=%v", candidates)
+    }
+
+    // the taken OpJumpNotTruthy breaks the sequence
+    for _, c := range profile.Candidates(2) {
+        if c.String() == "OpJumpNotTruthy OpNull" {
+            t.Errorf("sequence across a taken jump was counted")
+        }
+    }
+}
+
+// Constant indexes and jump targets past 65535 take wide operands.
+func TestWideOperands(t *testing.T) {
+    // x + 1 + ... + n with a new constant for every term
+    sum := func(x string, n int) string {
+        var src strings.Builder
+        src.WriteString(x)
+        for i := 1; i <= n; i++ {
+            fmt.Fprintf(&src, " + %d", i)
+        }
+        return src.String()
+    }
+
+    // a global for each of 0 to n - 1
+    lets := func(n int) string {
+        var src strings.Builder
+        for i := 0; i < n; i++ {
+            fmt.Fprintf(&src, "let g%d = %d; ", i, i)
+        }
+        return src.String()
+    }
+
+    tests := []vmTestCase{
+        {"let x = 0; " + sum("x", 70000), 70000 * 70001 / 2},
+        {lets(70000) + "g65535 + g65536 + g69999", 65535 + 65536 + 69999},
+        // the branch is longer than 65535 bytes
+        {"let x = 0; let c = true; let r = if (c) { " + sum("x", 20000) + " } else { -1 }; r", 20000 * 20001 / 2},
+        {"let x = 0; let c = false; let r = if (c) { " + sum("x", 20000) + " } else { -1 }; r", -1},
+    }
+
+    for _, opts := range []compiler.Options{{}, {Peephole: true, Superinstructions: true}} {
+        for _, test := range tests {
+            result := runWithOptions(t, test.input, opts)
+            testExpectedObject(t, test.expected, result)
+        }
+    }
+}
+
+func TestGlobalsLimit(t *testing.T) {
+    bytecode := &compiler.Bytecode{
+        Instructions: concatInstructions(
+            code.Make(code.OpGetGlobal, compiler.MaxGlobals),
+            code.Make(code.OpPop),
+        ),
+    }
+    err := New(bytecode).Run()
+    if err == nil || !strings.Contains(err.Error(), "the limit is") {
+        t.Errorf("expected an error for global %d. got=%v", compiler.MaxGlobals, err)
+    }
+
+    // the caller's store is not swapped for a longer one
+    bytecode = &compiler.Bytecode{
+        Instructions: concatInstructions(
+            code.Make(code.OpTrue),
+            code.Make(code.OpSetGlobal, GlobalsSize),
+        ),
+    }
+    globals := make([]object.Object, GlobalsSize)
+    err = NewWithGlobalsStore(bytecode, globals).Run()
+    if err == nil || !strings.Contains(err.Error(), "globals store too small") {
+        t.Errorf("expected an error for a short store. got=%v", err)
+    }
+
+    globals = make([]object.Object, GlobalsSize + 1)
+    err = NewWithGlobalsStore(bytecode, globals).Run()
+    if err != nil {
+        t.Fatalf("vm err: %s", err)
+    }
+    if globals[GlobalsSize] != True {
+        t.Errorf("global not stored in the caller's store. got=%v", globals[GlobalsSize])
+    }
+}
+
+func TestAssembledPrograms(t *testing.T) {
+    tests := []struct {
+        src string
+        expected interface{}
+    }{
+        {
+            // 1 / 0 is caught, the handler leaves the error message
+            `
+.constants
+    0 1
+    1 0
+.code
+.handler try catch catch 0
+try:
+    OpConst 0
+    OpConst 1
+    OpDiv
+    OpPop
+    OpJump end
+catch:
+    OpPop
+    OpConst 0
+    OpPop
+end:
+`,
+            1,
+        },
+        {
+            `
+.constants
+    0 2
+    1 "two"
+    2 "other"
+.code
+.table 1 other other two
+    OpConst 0
+    OpJumpTable 0
+two:
+    OpConst 1
+    OpJump end
+other:
+    OpConst 2
+end:
+    OpPop
+`,
+            "two",
+        },
+    }
+
+    for _, test := range tests {
+        bytecode, err := compiler.Assemble(test.src)
+        if err != nil {
+            t.Fatalf("assemble error: %s", err)
+        }
+
+        vm := New(bytecode)
+        err = vm.Run()
+        if err != nil {
+            t.Fatalf("vm error: %s", err)
+        }
+        testExpectedObject(t, test.expected, vm.LastPoppedStackElem())
+    }
+}
+
+func TestLinkedPrograms(t *testing.T) {
+    // a library with more than 65536 constants moves the script's past
+    // the 2-byte limit, so its OpConst inside the if become wide
+    var big strings.Builder
+    big.WriteString("let sum = 0")
+    for i := 1; i <= code.MaxOperand; i++ {
+        fmt.Fprintf(&big, " + %d", i)
+    }
+    big.WriteString("; let base = 10")
+
+    tests := []struct {
+        units []string
+        expected interface{}
+    }{
+        {[]string{"let one = 1", "let two = one + one", "one + two"}, 3},
+        {[]string{"let greet = \"hi\"", "if (true) { greet + \"!\" } else { 0 }"}, "hi!"},
+        {[]string{big.String(), "if (base > 5) { sum - 2147450880 + 100000 } else { 0 }"}, 100000},
+        {[]string{big.String(), "let next = base + 1; next"}, 11},
+        // a later unit's let shadows an earlier export
+        {[]string{"let n = 1; let libN = n", "let n = 10; n + libN"}, 11},
+        {[]string{"let helper = 2", "let h = helper; let helper = 3; h * 10 + helper"}, 23},
+        {[]string{"let n = 1", "let n = n + 10", "n * 2"}, 22},
+        {[]string{big.String(), "let base = base + 1; base"}, 11},
+    }
+
+    for _, test := range tests {
+        units := []*compiler.Unit{}
+        for i, src := range test.units {
+            u, err := compiler.CompileUnit(fmt.Sprintf("unit%d", i), parse(src), compiler.Options{})
+            if err != nil {
+                t.Fatalf("compiler error: %s", err)
+            }
+            units = append(units, u)
+        }
+
+        bytecode, err := compiler.Link(units...)
+        if err != nil {
+            t.Fatalf("link error: %s", err)
+        }
+
+        vm := New(bytecode)
+        err = vm.Run()
+        if err != nil {
+            t.Fatalf("vm error: %s", err)
+        }
+        testExpectedObject(t, test.expected, vm.LastPoppedStackElem())
+    }
+}
+
 func parse(input string) *ast.Program {
     l := lexer.New(input)
     p := parser.New(l)